@@ -0,0 +1,400 @@
+package codecs
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hdiniz/rtpdump/log"
+	"github.com/hdiniz/rtpdump/rtp"
+)
+
+// RFC 3640 - mpeg4-generic, AU headers section followed by access units
+// AU header := [AU-size(sizeLength)][AU-Index(indexLength) or AU-Index-delta(indexDeltaLength)] and optional fields
+// RFC 6416 - MP4A-LATM, AudioMuxElements with StreamMuxConfig in band or from the config parameter
+// both are written as ADTS, the 7 octet header taken from the AudioSpecificConfig
+
+const AAC_PAYLOAD_FORMAT_GENERIC = "mpeg4-generic"
+const AAC_PAYLOAD_FORMAT_LATM = "MP4A-LATM"
+
+const AAC_ADTS_HEADER_SIZE = 7
+const AAC_ADTS_MAX_FRAME_SIZE = 0x1FFF
+
+var aacSamplingFrequencies = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+var aacObjectTypes = map[int]string{1: "AAC Main", 2: "AAC LC", 3: "AAC SSR", 4: "AAC LTP"}
+
+// aacConfig holds what ADTS needs from an AudioSpecificConfig, ISO/IEC 14496-3 1.6.2.1
+// SBR and PS are left to implicit signalling, the core object type and sampling frequency are kept
+type aacConfig struct {
+	objectType     int
+	frequencyIndex int
+	channels       int
+	configured     bool
+}
+
+func readAudioObjectType(read func(int) int) int {
+	objectType := read(5)
+	if objectType == 31 {
+		objectType = 32 + read(6)
+	}
+	return objectType
+}
+
+func readSamplingFrequencyIndex(read func(int) int) (int, error) {
+	index := read(4)
+	if index != 15 {
+		return index, nil
+	}
+	frequency := read(24)
+	for i, v := range aacSamplingFrequencies {
+		if v == frequency {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("aac, sampling frequency %d has no ADTS index", frequency)
+}
+
+func readAudioSpecificConfig(r *bitReader) (config aacConfig, err error) {
+	read := func(n int) int {
+		v, e := r.readBits(n)
+		if e != nil && err == nil {
+			err = e
+		}
+		return int(v)
+	}
+
+	config.objectType = readAudioObjectType(read)
+	if config.frequencyIndex, err = readSamplingFrequencyIndex(read); err != nil {
+		return config, err
+	}
+	config.channels = read(4)
+	if config.objectType == 5 || config.objectType == 29 {
+		// SBR or PS, extension sampling frequency and the core object type follow
+		if _, err = readSamplingFrequencyIndex(read); err != nil {
+			return config, err
+		}
+		config.objectType = readAudioObjectType(read)
+	}
+	if _, ok := aacObjectTypes[config.objectType]; !ok {
+		return config, fmt.Errorf("aac, audio object type %d cannot be written as ADTS", config.objectType)
+	}
+	if config.channels == 0 || config.channels > 7 {
+		return config, errors.New("aac, program config element not supported")
+	}
+
+	// GASpecificConfig := [frameLengthFlag][dependsOnCoreCoder][coreCoderDelay(14)][extensionFlag]
+	read(1)
+	if read(1) == 1 {
+		read(14)
+	}
+	if read(1) == 1 {
+		read(1)
+	}
+	if config.frequencyIndex >= len(aacSamplingFrequencies) {
+		return config, errors.New("aac, reserved sampling frequency index")
+	}
+	config.configured = err == nil
+	return config, err
+}
+
+// adts prepends the ADTS header without CRC
+// [sync(12)][ID][layer(2)][protection absent][profile(2)][frequency index(4)][private][channels(3)]
+// [original][home][copyright id bit][copyright id start][frame length(13)][buffer fullness(11)][raw data blocks(2)]
+func (c aacConfig) adts(frame []byte) ([]byte, error) {
+	size := AAC_ADTS_HEADER_SIZE + len(frame)
+	if size > AAC_ADTS_MAX_FRAME_SIZE {
+		return nil, errors.New("aac, frame too large for ADTS")
+	}
+	header := []byte{
+		0xFF,
+		0xF1,
+		byte(c.objectType-1)<<6 | byte(c.frequencyIndex)<<2 | byte(c.channels>>2),
+		byte(c.channels&0x03)<<6 | byte(size>>11),
+		byte(size >> 3),
+		byte(size&0x07)<<5 | 0x1F,
+		0xFC,
+	}
+	return append(header, frame...), nil
+}
+
+type Aac struct {
+	latm   bool
+	config aacConfig
+
+	// RFC 3640 AU header fields, in bits
+	sizeLength              int
+	indexLength             int
+	indexDeltaLength        int
+	ctsDeltaLength          int
+	dtsDeltaLength          int
+	randomAccessIndication  bool
+	streamStateIndication   int
+	auxiliaryDataSizeLength int
+
+	// RFC 6416 StreamMuxConfig, in band when cpresent
+	cpresent bool
+	mux      latmMuxConfig
+
+	started bool
+	lastSeq uint16
+
+	fragmenting       bool
+	fragmentTimestamp uint32
+	fragment          []byte
+
+	frames        int
+	droppedFrames int
+	lostPackets   int
+}
+
+func NewAac() Codec {
+	return &Aac{}
+}
+
+func (c *Aac) Init() {
+}
+
+func (c *Aac) SetOptions(options map[string]string) (err error) {
+	// RFC 3640 parameter names are case-insensitive, looked up lower-cased
+	fmtp := make(map[string]string)
+	for k, v := range ParseFmtp(options["fmtp"]) {
+		fmtp[strings.ToLower(k)] = v
+	}
+	integer := func(name string, value int) int {
+		if v, ok := fmtp[strings.ToLower(name)]; ok && err == nil {
+			if value, err = strconv.Atoi(v); err != nil || value < 0 || value > 32 {
+				err = errors.New("invalid " + name)
+			}
+		}
+		return value
+	}
+
+	switch options["payload-format"] {
+	case AAC_PAYLOAD_FORMAT_GENERIC:
+		// AAC-hbr and AAC-lbr imply the AU header layout, other modes give it in full
+		switch strings.ToLower(fmtp["mode"]) {
+		case "aac-hbr":
+			c.sizeLength, c.indexLength, c.indexDeltaLength = 13, 3, 3
+		case "aac-lbr":
+			c.sizeLength, c.indexLength, c.indexDeltaLength = 6, 2, 2
+		}
+		c.sizeLength = integer("sizeLength", c.sizeLength)
+		c.indexLength = integer("indexLength", c.indexLength)
+		c.indexDeltaLength = integer("indexDeltaLength", c.indexDeltaLength)
+		c.ctsDeltaLength = integer("CTSDeltaLength", 0)
+		c.dtsDeltaLength = integer("DTSDeltaLength", 0)
+		c.randomAccessIndication = integer("randomAccessIndication", 0) == 1
+		c.streamStateIndication = integer("streamStateIndication", 0)
+		c.auxiliaryDataSizeLength = integer("auxiliaryDataSizeLength", 0)
+		if err != nil {
+			return err
+		}
+		if c.sizeLength == 0 {
+			return errors.New("aac, sizeLength or mode required")
+		}
+		config, err := hex.DecodeString(fmtp["config"])
+		if err != nil || len(config) == 0 {
+			return errors.New("invalid config")
+		}
+		c.config, err = readAudioSpecificConfig(newBitReader(config))
+		return err
+	case AAC_PAYLOAD_FORMAT_LATM:
+		c.latm = true
+		c.cpresent = fmtp["cpresent"] != "0"
+		if c.cpresent {
+			return nil
+		}
+		config, err := hex.DecodeString(fmtp["config"])
+		if err != nil || len(config) == 0 {
+			return errors.New("invalid config")
+		}
+		c.mux, err = readStreamMuxConfig(newBitReader(config))
+		return err
+	}
+	return errors.New("invalid codec option value")
+}
+
+// GetFormatMagic is empty, each ADTS frame carries its own header
+func (c Aac) GetFormatMagic() []byte {
+	return []byte{}
+}
+
+func (c *Aac) GetAnalysis() string {
+	config := c.config
+	if c.latm {
+		config = c.mux.config
+	}
+	rate := 0
+	if config.configured {
+		rate = aacSamplingFrequencies[config.frequencyIndex]
+	}
+	return fmt.Sprintf("Audio object type: %d (%s)\nSampling rate: %d\nChannels: %d\nFrames: %d\nFrames dropped: %d\nLost packets: %d\n",
+		config.objectType, aacObjectTypes[config.objectType], rate,
+		config.channels, c.frames, c.droppedFrames, c.lostPackets)
+}
+
+func (c *Aac) HandleRtpPacket(packet *rtp.RtpPacket) (result []byte, err error) {
+	lost := c.started && packet.SequenceNumber != c.lastSeq+1
+	if lost {
+		c.lostPackets += int(packet.SequenceNumber - c.lastSeq - 1)
+		log.Sdebug("aac, lost packets before seq:%d", packet.SequenceNumber)
+	}
+	c.lastSeq = packet.SequenceNumber
+	c.started = true
+
+	// a fragmented frame is given up once a fragment is lost
+	if c.fragmenting && (lost || packet.Timestamp != c.fragmentTimestamp) {
+		c.dropFragment("lost fragments")
+	}
+
+	if c.latm {
+		return c.handleLatm(packet)
+	}
+	return c.handleGeneric(packet)
+}
+
+func (c *Aac) handleGeneric(packet *rtp.RtpPacket) (result []byte, err error) {
+	payload := packet.Payload
+	if len(payload) < 2 {
+		return nil, errors.New("aac, payload too short for AU headers length")
+	}
+	headersLength := int(payload[0])<<8 | int(payload[1])
+	offset := 2 + (headersLength+7)/8
+	if len(payload) < offset {
+		return nil, errors.New("aac, payload too short for AU headers")
+	}
+	sizes, err := c.readAuHeaders(newBitReader(payload[2:offset]), headersLength)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.auxiliaryDataSizeLength > 0 {
+		r := newBitReader(payload[offset:])
+		size, err := r.readBits(c.auxiliaryDataSizeLength)
+		if err != nil {
+			return nil, errors.New("aac, payload too short for auxiliary data")
+		}
+		offset += (c.auxiliaryDataSizeLength + int(size) + 7) / 8
+	}
+	if len(payload) < offset {
+		return nil, errors.New("aac, payload too short for auxiliary data")
+	}
+	data := payload[offset:]
+
+	// a single access unit larger than the payload is fragmented, the marker bit ends it
+	if len(sizes) == 1 && (c.fragmenting || sizes[0] > len(data)) {
+		if !c.fragmenting {
+			c.fragmenting = true
+			c.fragmentTimestamp = packet.Timestamp
+		}
+		c.fragment = append(c.fragment, data...)
+		if len(c.fragment) < sizes[0] {
+			if packet.Marker {
+				c.dropFragment("marker bit before access unit end")
+			}
+			return nil, nil
+		}
+		frame := c.fragment[:sizes[0]]
+		c.fragmenting = false
+		c.fragment = nil
+		return c.writeFrame(c.config, frame)
+	}
+
+	for _, size := range sizes {
+		if len(data) < size {
+			c.droppedFrames++
+			return result, errors.New("aac, payload too short for access unit")
+		}
+		frame, err := c.writeFrame(c.config, data[:size])
+		if err != nil {
+			return result, err
+		}
+		result = append(result, frame...)
+		data = data[size:]
+	}
+	return result, nil
+}
+
+// readAuHeaders returns the access unit sizes, interleaved access units are not reordered
+func (c *Aac) readAuHeaders(r *bitReader, headersLength int) (sizes []int, err error) {
+	read := func(n int) int {
+		v, e := r.readBits(n)
+		if e != nil && err == nil {
+			err = errors.New("aac, AU headers too short")
+		}
+		return int(v)
+	}
+	for r.offset < headersLength && err == nil {
+		sizes = append(sizes, read(c.sizeLength))
+		if len(sizes) == 1 {
+			if read(c.indexLength) != 0 {
+				return nil, errors.New("aac, interleaving not supported")
+			}
+		} else if read(c.indexDeltaLength) != 0 {
+			return nil, errors.New("aac, interleaving not supported")
+		}
+		if c.ctsDeltaLength > 0 && read(1) == 1 {
+			read(c.ctsDeltaLength)
+		}
+		if c.dtsDeltaLength > 0 && read(1) == 1 {
+			read(c.dtsDeltaLength)
+		}
+		if c.randomAccessIndication {
+			read(1)
+		}
+		read(c.streamStateIndication)
+	}
+	return sizes, err
+}
+
+func (c *Aac) writeFrame(config aacConfig, frame []byte) ([]byte, error) {
+	if !config.configured {
+		c.droppedFrames++
+		return nil, errors.New("aac, frame before stream mux config")
+	}
+	result, err := config.adts(frame)
+	if err != nil {
+		c.droppedFrames++
+		return nil, err
+	}
+	c.frames++
+	return result, nil
+}
+
+func (c *Aac) dropFragment(reason string) {
+	if c.fragmenting {
+		log.Swarn("aac, incomplete frame dropped, %s", reason)
+		c.droppedFrames++
+	}
+	c.fragmenting = false
+	c.fragment = nil
+}
+
+var AacMetadata = CodecMetadata{
+	Name:     "aac",
+	LongName: "MPEG-4 AAC",
+	Options: []CodecOption{
+		aacPayloadFormatOption,
+		aacFmtpOption,
+	},
+	Init: NewAac,
+}
+
+var aacPayloadFormatOption = CodecOption{
+	Required:         true,
+	Name:             "payload-format",
+	Description:      "a=rtpmap encoding name of the stream",
+	ValidValues:      []string{AAC_PAYLOAD_FORMAT_GENERIC, AAC_PAYLOAD_FORMAT_LATM},
+	ValueDescription: []string{"RFC 3640, AAC-hbr and AAC-lbr modes or explicit AU header lengths", "RFC 6416, LATM"},
+	RestrictValues:   true,
+}
+
+var aacFmtpOption = CodecOption{
+	Required:       false,
+	Name:           "fmtp",
+	Description:    "a=fmtp parameters, used for config, mode and AU header lengths, cpresent for LATM",
+	RestrictValues: false,
+}
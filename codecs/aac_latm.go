@@ -0,0 +1,144 @@
+package codecs
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hdiniz/rtpdump/log"
+	"github.com/hdiniz/rtpdump/rtp"
+)
+
+// RFC 6416 - LATM, ISO/IEC 14496-3 1.7.3, an AudioMuxElement may span packets up to the one with the marker bit
+// AudioMuxElement := [useSameStreamMux][StreamMuxConfig] when in band, then per sub frame
+// PayloadLengthInfo, octets summed up to the first one below 255, and PayloadMux
+
+type latmMuxConfig struct {
+	config        aacConfig
+	subFrames     int
+	otherDataBits int
+}
+
+// readStreamMuxConfig supports audioMuxVersion 0 with a single program and layer, frameLengthType 0
+func readStreamMuxConfig(r *bitReader) (mux latmMuxConfig, err error) {
+	read := func(n int) int {
+		v, e := r.readBits(n)
+		if e != nil && err == nil {
+			err = errors.New("latm, stream mux config too short")
+		}
+		return int(v)
+	}
+
+	if read(1) == 1 {
+		return mux, errors.New("latm, audioMuxVersion 1 not supported")
+	}
+	// allStreamsSameTimeFraming, a single layer is framed alike anyway
+	read(1)
+	mux.subFrames = read(6) + 1
+	if read(4) != 0 || read(3) != 0 {
+		return mux, errors.New("latm, multiple programs or layers not supported")
+	}
+	if mux.config, err = readAudioSpecificConfig(r); err != nil {
+		return mux, err
+	}
+	if frameLengthType := read(3); frameLengthType != 0 {
+		return mux, fmt.Errorf("latm, frameLengthType %d not supported", frameLengthType)
+	}
+	// latmBufferFullness
+	read(8)
+	if read(1) == 1 {
+		// otherDataLenBits, 8 bit values while escaped
+		for escape := 1; escape == 1 && err == nil; {
+			escape = read(1)
+			mux.otherDataBits = mux.otherDataBits<<8 | read(8)
+		}
+	}
+	// crcCheckPresent, crcCheckSum
+	if read(1) == 1 {
+		read(8)
+	}
+	return mux, err
+}
+
+func (c *Aac) handleLatm(packet *rtp.RtpPacket) (result []byte, err error) {
+	if !c.fragmenting {
+		c.fragmenting = true
+		c.fragmentTimestamp = packet.Timestamp
+	}
+	c.fragment = append(c.fragment, packet.Payload...)
+	if !packet.Marker {
+		return nil, nil
+	}
+	data := c.fragment
+	c.fragmenting = false
+	c.fragment = nil
+
+	// AudioMuxElements are octet aligned
+	r := newBitReader(data)
+	for r.remaining() >= 8 {
+		frames, err := c.readAudioMuxElement(r)
+		result = append(result, frames...)
+		if err != nil {
+			return result, err
+		}
+		r.offset = (r.offset + 7) / 8 * 8
+	}
+	return result, nil
+}
+
+func (c *Aac) readAudioMuxElement(r *bitReader) (result []byte, err error) {
+	if c.cpresent {
+		useSameStreamMux, err := r.readBit()
+		if err != nil {
+			return nil, err
+		}
+		if useSameStreamMux == 0 {
+			mux, err := readStreamMuxConfig(r)
+			if err != nil {
+				c.droppedFrames++
+				return nil, err
+			}
+			if mux.config != c.mux.config {
+				log.Sdebug("latm, stream mux config, object type:%d, frequency index:%d, channels:%d",
+					mux.config.objectType, mux.config.frequencyIndex, mux.config.channels)
+			}
+			c.mux = mux
+		}
+	}
+
+	if !c.mux.config.configured {
+		c.droppedFrames++
+		return nil, errors.New("latm, audio mux element before stream mux config")
+	}
+	for i := 0; i < c.mux.subFrames; i++ {
+		size := 0
+		for {
+			v, err := r.readBits(8)
+			if err != nil {
+				c.droppedFrames++
+				return result, errors.New("latm, payload too short for length info")
+			}
+			size += int(v)
+			if v != 255 {
+				break
+			}
+		}
+		frame, err := r.readAligned(8 * size)
+		if err != nil {
+			c.droppedFrames++
+			return result, errors.New("latm, payload too short for payload mux")
+		}
+		frame, err = c.writeFrame(c.mux.config, frame)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, frame...)
+	}
+
+	if c.mux.otherDataBits > 0 {
+		if r.remaining() < c.mux.otherDataBits {
+			return result, errors.New("latm, payload too short for other data")
+		}
+		r.offset += c.mux.otherDataBits
+	}
+	return result, nil
+}
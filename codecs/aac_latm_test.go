@@ -0,0 +1,167 @@
+package codecs
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/hdiniz/rtpdump/rtp"
+)
+
+// AAC LC, 44.1 kHz, stereo, a single sub frame, RFC 6416 style config
+const testLatmConfig = "400024203fc0"
+
+// testAdtsLcStereo44k is the ADTS header for an AAC LC 44.1 kHz stereo frame of size octets
+func testAdtsLcStereo44k(size int) []byte {
+	size += AAC_ADTS_HEADER_SIZE
+	return []byte{0xFF, 0xF1, 0x50, 0x80 | byte(size>>11), byte(size >> 3), byte(size&0x07)<<5 | 0x1F, 0xFC}
+}
+
+// testBitWriter packs fields of any bit length, most significant bit first
+type testBitWriter struct {
+	data []byte
+	bits int
+}
+
+func (w *testBitWriter) write(value uint, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.bits%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		w.data[len(w.data)-1] |= byte(value>>uint(i)&0x01) << uint(7-w.bits%8)
+		w.bits++
+	}
+}
+
+func (w *testBitWriter) writeBytes(data []byte) {
+	for _, v := range data {
+		w.write(uint(v), 8)
+	}
+}
+
+func testLatmPayloadLength(w *testBitWriter, size int) {
+	for ; size >= 255; size -= 255 {
+		w.write(255, 8)
+	}
+	w.write(uint(size), 8)
+}
+
+func TestReadStreamMuxConfig(t *testing.T) {
+	config, _ := hex.DecodeString(testLatmConfig)
+	mux, err := readStreamMuxConfig(newBitReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := aacConfig{objectType: 2, frequencyIndex: 4, channels: 2, configured: true}
+	if mux.config != expected || mux.subFrames != 1 || mux.otherDataBits != 0 {
+		t.Errorf("got %+v", mux)
+	}
+
+	// audioMuxVersion 1
+	if _, err = readStreamMuxConfig(newBitReader([]byte{0x80, 0x00, 0x24, 0x20, 0x3F, 0xC0})); err == nil {
+		t.Error("audioMuxVersion 1 accepted")
+	}
+	// cut in the AudioSpecificConfig
+	if _, err = readStreamMuxConfig(newBitReader(config[:2])); err == nil {
+		t.Error("short config accepted")
+	}
+}
+
+func TestLatmOutOfBandConfig(t *testing.T) {
+	c := NewAac()
+	if err := c.SetOptions(map[string]string{
+		"payload-format": AAC_PAYLOAD_FORMAT_LATM,
+		"fmtp":           "cpresent=0; config=" + testLatmConfig,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	frame := make([]byte, 300)
+	for i := range frame {
+		frame[i] = byte(i)
+	}
+	var w testBitWriter
+	testLatmPayloadLength(&w, len(frame))
+	w.writeBytes(frame)
+
+	// the AudioMuxElement spans two packets, up to the marker bit
+	var result []byte
+	for i, p := range []*rtp.RtpPacket{
+		{SequenceNumber: 1, Timestamp: 1024, Payload: w.data[:100]},
+		{SequenceNumber: 2, Timestamp: 1024, Payload: w.data[100:], Marker: true},
+	} {
+		frames, err := c.HandleRtpPacket(p)
+		if err != nil {
+			t.Fatalf("packet %d: %s", i, err)
+		}
+		result = append(result, frames...)
+	}
+
+	expected := append(testAdtsLcStereo44k(len(frame)), frame...)
+	if !bytes.Equal(result, expected) {
+		t.Errorf("got % X\nexpected % X", result, expected)
+	}
+}
+
+func TestLatmInBandConfig(t *testing.T) {
+	c := NewAac()
+	if err := c.SetOptions(map[string]string{"payload-format": AAC_PAYLOAD_FORMAT_LATM}); err != nil {
+		t.Fatal(err)
+	}
+	config, _ := hex.DecodeString(testLatmConfig)
+
+	// StreamMuxConfig is 44 bits long, the first payload is not octet aligned after it
+	var first testBitWriter
+	first.write(0, 1)
+	for _, v := range config[:5] {
+		first.write(uint(v), 8)
+	}
+	first.write(uint(config[5]>>4), 4)
+	testLatmPayloadLength(&first, 3)
+	first.writeBytes([]byte{0x01, 0x02, 0x03})
+
+	// useSameStreamMux
+	var second testBitWriter
+	second.write(1, 1)
+	testLatmPayloadLength(&second, 2)
+	second.writeBytes([]byte{0x04, 0x05})
+
+	var result []byte
+	for i, payload := range [][]byte{first.data, second.data} {
+		frames, err := c.HandleRtpPacket(&rtp.RtpPacket{
+			SequenceNumber: uint16(i), Timestamp: uint32(1024 * i), Payload: payload, Marker: true,
+		})
+		if err != nil {
+			t.Fatalf("packet %d: %s", i, err)
+		}
+		result = append(result, frames...)
+	}
+
+	var expected []byte
+	expected = append(append(expected, testAdtsLcStereo44k(3)...), 0x01, 0x02, 0x03)
+	expected = append(append(expected, testAdtsLcStereo44k(2)...), 0x04, 0x05)
+	if !bytes.Equal(result, expected) {
+		t.Errorf("got % X\nexpected % X", result, expected)
+	}
+}
+
+func TestLatmLostFragment(t *testing.T) {
+	c := NewAac()
+	c.SetOptions(map[string]string{
+		"payload-format": AAC_PAYLOAD_FORMAT_LATM,
+		"fmtp":           "cpresent=0;config=" + testLatmConfig,
+	})
+
+	frames, _ := c.HandleRtpPacket(&rtp.RtpPacket{SequenceNumber: 1, Timestamp: 0, Payload: []byte{0x04, 0x01}})
+	// the packet ending the first element was lost, the next one starts a new element
+	more, err := c.HandleRtpPacket(&rtp.RtpPacket{SequenceNumber: 3, Timestamp: 1024, Payload: []byte{0x01, 0x09}, Marker: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames = append(frames, more...)
+
+	expected := append(testAdtsLcStereo44k(1), 0x09)
+	if !bytes.Equal(frames, expected) {
+		t.Errorf("got % X, expected % X", frames, expected)
+	}
+}
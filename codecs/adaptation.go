@@ -0,0 +1,121 @@
+package codecs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hdiniz/rtpdump/rtp"
+	"github.com/hdiniz/rtpdump/util"
+)
+
+var AMR_NB_MODE_NAMES []string = []string{"4.75", "5.15", "5.90", "6.70", "7.40", "7.95", "10.2", "12.2"}
+var AMR_WB_MODE_NAMES []string = []string{"6.60", "8.85", "12.65", "14.25", "15.85", "18.25", "19.85", "23.05", "23.85"}
+var EVS_PRIMARY_MODE_NAMES []string = []string{"2.8", "7.2", "8.0", "9.6", "13.2", "16.4", "24.4", "32", "48", "64", "96", "128"}
+
+// ModeEvent is a codec mode request (CMR) or a change of the sent mode
+type ModeEvent struct {
+	ReceivedAt time.Time
+	Timestamp  uint32
+	Mode       string
+	Detail     string
+}
+
+func (e ModeEvent) String() string {
+	mode := e.Mode
+	if mode == "" {
+		mode = "no request"
+	}
+	if e.Detail != "" {
+		mode += " " + e.Detail
+	}
+	return fmt.Sprintf("%s - %d - %s", util.TimeMsToStr(e.ReceivedAt), e.Timestamp, mode)
+}
+
+// ModeAdaptation is implemented by speech codecs tracking rate adaptation,
+// requests in one direction are answered by mode changes in the other
+type ModeAdaptation interface {
+	GetModeRequests() []ModeEvent
+	GetModeChanges() []ModeEvent
+}
+
+type modeTracker struct {
+	requests []ModeEvent
+	changes  []ModeEvent
+
+	hasRequest    bool
+	lastRequest   ModeEvent
+	hasMode       bool
+	lastMode      string
+	lastTimestamp uint32
+}
+
+// request records a CMR when its value changes, empty mode means no request
+func (t *modeTracker) request(packet *rtp.RtpPacket, mode string, detail string) {
+	if t.hasRequest && t.lastRequest.Mode == mode && t.lastRequest.Detail == detail {
+		return
+	}
+	t.hasRequest = true
+	t.lastRequest = ModeEvent{packet.ReceivedAt, packet.Timestamp, mode, detail}
+	t.requests = append(t.requests, t.lastRequest)
+}
+
+// frame records the mode of a sent speech frame when it changes, redundant frames are ignored
+func (t *modeTracker) frame(packet *rtp.RtpPacket, timestamp uint32, mode string) {
+	if t.hasMode && int32(timestamp-t.lastTimestamp) <= 0 {
+		return
+	}
+	changed := !t.hasMode || t.lastMode != mode
+	t.hasMode = true
+	t.lastTimestamp = timestamp
+	if changed {
+		t.lastMode = mode
+		t.changes = append(t.changes, ModeEvent{packet.ReceivedAt, timestamp, mode, ""})
+	}
+}
+
+func (t *modeTracker) timeline() string {
+	result := fmt.Sprintf("Mode changes: %d\n", len(t.changes))
+	for _, v := range t.changes {
+		result += fmt.Sprintf("\t%s\n", v)
+	}
+	result += fmt.Sprintf("Mode requests (CMR): %d\n", len(t.requests))
+	for _, v := range t.requests {
+		result += fmt.Sprintf("\t%s\n", v)
+	}
+	return result
+}
+
+// ModeAdaptationAnalysis reports how long the reverse direction took to
+// obey each mode request sent in the forward direction
+func ModeAdaptationAnalysis(forward ModeAdaptation, reverse ModeAdaptation) string {
+	changes := reverse.GetModeChanges()
+	result := "Mode request latency:\n"
+	for _, request := range forward.GetModeRequests() {
+		if request.Mode == "" {
+			continue
+		}
+
+		// mode already in use when the request was sent
+		current := ""
+		for _, change := range changes {
+			if change.ReceivedAt.After(request.ReceivedAt) {
+				break
+			}
+			current = change.Mode
+		}
+
+		answer := "not obeyed"
+		if current == request.Mode {
+			answer = "already in use"
+		} else {
+			for _, change := range changes {
+				if change.ReceivedAt.After(request.ReceivedAt) && change.Mode == request.Mode {
+					answer = fmt.Sprintf("%d ms", change.ReceivedAt.Sub(request.ReceivedAt).Nanoseconds()/1000000)
+					break
+				}
+			}
+		}
+		result += fmt.Sprintf("\t%s -> %s\n", request, answer)
+	}
+	return result
+}
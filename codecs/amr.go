@@ -2,6 +2,9 @@ package codecs
 
 import (
 	"errors"
+	"fmt"
+	"sort"
+	"strconv"
 
 	"github.com/hdiniz/rtpdump/log"
 	"github.com/hdiniz/rtpdump/rtp"
@@ -9,25 +12,63 @@ import (
 
 const AMR_NB_MAGIC string = "#!AMR\n"
 const AMR_WB_MAGIC string = "#!AMR-WB\n"
+const AMR_NB_MC_MAGIC string = "#!AMR_MC1.0\n"
+const AMR_WB_MC_MAGIC string = "#!AMR-WB_MC1.0\n"
 
 var AMR_NB_FRAME_SIZE []int = []int{12, 13, 15, 17, 19, 20, 26, 31, 5, 0, 0, 0, 0, 0, 0, 0}
 var AMR_WB_FRAME_SIZE []int = []int{17, 23, 32, 36, 40, 46, 50, 58, 60, 5, 5, 0, 0, 0, 0, 0}
 
+var AMR_NB_FRAME_BITS []int = []int{95, 103, 118, 134, 148, 159, 204, 244, 39, 0, 0, 0, 0, 0, 0, 0}
+var AMR_WB_FRAME_BITS []int = []int{132, 177, 253, 285, 317, 365, 397, 461, 477, 40, 0, 0, 0, 0, 0, 0}
+
+// bits covered by frame CRC, 3GPP TS 26.101 and TS 26.201
+var AMR_NB_CLASS_A_BITS []int = []int{42, 49, 55, 58, 61, 75, 65, 81, 39, 0, 0, 0, 0, 0, 0, 0}
+var AMR_WB_CLASS_A_BITS []int = []int{54, 64, 72, 72, 72, 72, 72, 72, 72, 40, 0, 0, 0, 0, 0, 0}
+
 const AMR_NB_SAMPLE_RATE = 8000
 const AMR_WB_SAMPLE_RATE = 16000
 
+const AMR_MAX_CHANNELS = 6
+
+// frame types with no speech mode, besides SID
+const AMR_SPEECH_LOST = 14
+const AMR_NO_DATA = 15
+
 type Amr struct {
-	started      bool
-	configured   bool
-	sampleRate   int
-	octetAligned bool
-	timestamp    uint32
+	started       bool
+	configured    bool
+	sampleRate    int
+	octetAligned  bool
+	channels      int
+	crc           bool
+	robustSorting bool
+	interleaving  bool
+	timestamp     uint32
+
+	// flavor auto-detection from the first packets
+	autoSampleRate   bool
+	autoOctetAligned bool
+	detected         bool
+	detectBuffer     []*rtp.RtpPacket
+	detectConfidence float64
+	detection        string
 
 	lastSeq uint16
+
+	// frame-blocks waiting for de-interleaving
+	pending []amrFrameBlock
+
+	frames          int
+	lostFrames      int
+	redundantFrames int
+	corruptedFrames int
+
+	modes modeTracker
+	dtx   dtxTracker
 }
 
 func NewAmr() Codec {
-	return &Amr{started: false, configured: false, timestamp: 0}
+	return &Amr{started: false, configured: false, timestamp: 0, channels: 1}
 }
 
 func (amr *Amr) Init() {
@@ -38,6 +79,20 @@ func (amr *Amr) isWideBand() bool {
 }
 
 func (amr Amr) GetFormatMagic() []byte {
+	if amr.isDetecting() {
+		// written along with the first frames once the flavor is known
+		return []byte{}
+	}
+	if amr.channels > 1 {
+		// multi-channel magic is followed by the channel description field
+		var magic []byte
+		if amr.isWideBand() {
+			magic = []byte(AMR_WB_MC_MAGIC)
+		} else {
+			magic = []byte(AMR_NB_MC_MAGIC)
+		}
+		return append(magic, 0x00, 0x00, 0x00, byte(amr.channels&0x0F))
+	}
 	if amr.isWideBand() {
 		return []byte(AMR_WB_MAGIC)
 	} else {
@@ -54,25 +109,67 @@ func (amr *Amr) SetOptions(options map[string]string) error {
 		return amr.invalidState()
 	}
 
+	// fmtp parameters fill options not explicitly given
+	fmtp := ParseFmtp(options["fmtp"])
+	option := func(name string) (string, bool) {
+		if v, ok := options[name]; ok {
+			return v, ok
+		}
+		v, ok := fmtp[name]
+		return v, ok
+	}
+
+	// octet-aligned and sample-rate are detected from the stream when not given
 	v, ok := options["octet-aligned"]
 	if !ok {
-		return errors.New("required codec option not present")
+		v, ok = fmtp["octet-align"]
 	}
-
+	amr.autoOctetAligned = !ok
 	amr.octetAligned = v == "1"
 
 	v, ok = options["sample-rate"]
-	if !ok {
-		return errors.New("required codec option not present")
-	}
+	amr.autoSampleRate = !ok
 
-	if v == "nb" {
+	if !ok {
+		amr.sampleRate = AMR_NB_SAMPLE_RATE
+	} else if v == "nb" {
 		amr.sampleRate = AMR_NB_SAMPLE_RATE
 	} else if v == "wb" {
 		amr.sampleRate = AMR_WB_SAMPLE_RATE
 	} else {
 		return errors.New("invalid codec option value")
 	}
+
+	if v, ok = options["channels"]; ok {
+		channels, err := strconv.Atoi(v)
+		if err != nil || channels < 1 || channels > AMR_MAX_CHANNELS {
+			return errors.New("invalid codec option value")
+		}
+		amr.channels = channels
+	}
+
+	v, _ = option("crc")
+	amr.crc = v == "1"
+	v, _ = option("robust-sorting")
+	amr.robustSorting = v == "1"
+
+	// interleaving value is the maximum frame-blocks per group, only its presence matters here
+	if v, ok = option("interleaving"); ok {
+		if _, err := strconv.Atoi(v); err != nil {
+			return errors.New("invalid codec option value")
+		}
+		amr.interleaving = true
+	}
+
+	if amr.autoOctetAligned && (amr.crc || amr.robustSorting || amr.interleaving) {
+		amr.autoOctetAligned = false
+		amr.octetAligned = true
+	}
+
+	if !amr.octetAligned && (amr.crc || amr.robustSorting || amr.interleaving) {
+		return errors.New("crc, robust-sorting and interleaving require octet-aligned mode")
+	}
+
 	amr.configured = true
 	return nil
 }
@@ -86,33 +183,191 @@ func (amr *Amr) HandleRtpPacket(packet *rtp.RtpPacket) (result []byte, err error
 		return nil, errors.New("Ignore out of sequence")
 	}
 
-	result = append(result, amr.handleMissingSamples(packet.Timestamp)...)
+	if amr.isDetecting() {
+		return amr.handleDetection(packet), nil
+	}
 
-	var speechFrame []byte
+	var payload *amrPayload
 	if amr.octetAligned {
-		speechFrame, err = amr.handleOaMode(packet.Timestamp, packet.Payload)
+		payload, err = amr.handleOaMode(packet.Payload)
 	} else {
-		speechFrame, err = amr.handleBeMode(packet.Timestamp, packet.Payload)
+		payload, err = amr.handleBeMode(packet.Payload)
 	}
 
 	if err != nil {
 		return nil, err
 	}
-	result = append(result, speechFrame...)
+
+	blocks, err := amr.frameBlocks(packet.Timestamp, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(blocks) > 0 {
+		blocks[0].talkspurt = packet.Marker
+	}
+
+	amr.modes.request(packet, amr.getModeName(payload.cmr), "")
+	for _, block := range blocks {
+		if mode := amr.getModeName(block.frames[0].frameType); mode != "" {
+			amr.modes.frame(packet, block.timestamp, mode)
+		}
+	}
+
+	if amr.interleaving {
+		return amr.deinterleave(payload.ilp, blocks), nil
+	}
+
+	for _, block := range blocks {
+		result = append(result, amr.writeFrameBlock(block)...)
+	}
 	return result, nil
 }
 
-func (amr *Amr) handleMissingSamples(timestamp uint32) (result []byte) {
-	if amr.timestamp != 0 {
-		lostSamplesFromPrevious := ((timestamp - amr.timestamp) / (uint32(amr.sampleRate) / 50)) - 1
-		log.Sdebug("lostSamplesFromPrevious: %d, time: %d", lostSamplesFromPrevious, lostSamplesFromPrevious*20)
-		for i := lostSamplesFromPrevious; i > 0; i-- {
-			if amr.isWideBand() {
-				result = append(result, 0xFC)
-			} else {
-				result = append(result, 0x7C)
-			}
+// Flush writes frame-blocks still waiting for de-interleaving
+func (amr *Amr) Flush() (result []byte) {
+	if amr.isDetecting() && len(amr.detectBuffer) > 0 {
+		// stream shorter than detection window
+		result = amr.detectFlavor()
+	}
+	result = append(result, amr.writePending(amr.timestamp, true)...)
+	amr.pending = nil
+	return result
+}
+
+func (amr *Amr) GetAnalysis() string {
+	result := ""
+	if amr.detected {
+		result += fmt.Sprintf("Detected: %s\n", amr.detection)
+	}
+	return result + fmt.Sprintf(
+		"Frames: %d\nLost frames: %d\nRedundant frames: %d\nCorrupted frames: %d\n",
+		amr.frames, amr.lostFrames, amr.redundantFrames, amr.corruptedFrames) +
+		amr.dtx.analysis(amr.sampleRate) + amr.modes.timeline()
+}
+
+func (amr *Amr) GetModeRequests() []ModeEvent {
+	return amr.modes.requests
+}
+
+func (amr *Amr) GetModeChanges() []ModeEvent {
+	return amr.modes.changes
+}
+
+// getModeName names a speech mode from CMR or frame type, empty for SID, no data or no request
+func (amr *Amr) getModeName(mode int) string {
+	if amr.isWideBand() && mode < len(AMR_WB_MODE_NAMES) {
+		return "AMR-WB " + AMR_WB_MODE_NAMES[mode]
+	}
+	if !amr.isWideBand() && mode < len(AMR_NB_MODE_NAMES) {
+		return "AMR " + AMR_NB_MODE_NAMES[mode]
+	}
+	return ""
+}
+
+func (amr *Amr) samplesPerFrame() int {
+	return amr.sampleRate / 50
+}
+
+// frameBlocks groups one frame per channel and assigns each group its timestamp.
+// RTP timestamp refers to the first frame-block in the payload, following blocks
+// are consecutive 20ms blocks, or ILL+1 blocks apart when interleaving
+func (amr *Amr) frameBlocks(timestamp uint32, payload *amrPayload) ([]amrFrameBlock, error) {
+	if len(payload.frames)%amr.channels != 0 {
+		return nil, errors.New("Amr frame count does not match number of channels")
+	}
+
+	var blocks []amrFrameBlock
+	for i := 0; i < len(payload.frames)/amr.channels; i++ {
+		blocks = append(blocks, amrFrameBlock{
+			timestamp: timestamp + uint32(amr.samplesPerFrame()*(payload.ill+1)*i),
+			frames:    payload.frames[i*amr.channels : (i+1)*amr.channels],
+		})
+	}
+	return blocks, nil
+}
+
+func (amr *Amr) deinterleave(ilp int, blocks []amrFrameBlock) (result []byte) {
+	if ilp == 0 && len(blocks) > 0 {
+		// start of a new interleaving group, previous groups are complete
+		result = amr.writePending(blocks[0].timestamp, false)
+	}
+	amr.pending = append(amr.pending, blocks...)
+	return result
+}
+
+func (amr *Amr) writePending(timestamp uint32, all bool) (result []byte) {
+	sort.Slice(amr.pending, func(i, j int) bool {
+		return int32(amr.pending[i].timestamp-amr.pending[j].timestamp) < 0
+	})
+
+	var remaining []amrFrameBlock
+	for _, block := range amr.pending {
+		if all || int32(block.timestamp-timestamp) < 0 {
+			result = append(result, amr.writeFrameBlock(block)...)
+		} else {
+			remaining = append(remaining, block)
+		}
+	}
+	amr.pending = remaining
+	return result
+}
+
+func (amr *Amr) writeFrameBlock(block amrFrameBlock) (result []byte) {
+	if amr.started && int32(block.timestamp-amr.timestamp) <= 0 {
+		log.Sdebug("redundant frame, timestamp:%d already written", block.timestamp)
+		amr.redundantFrames += len(block.frames)
+		return nil
+	}
+
+	result = append(result, amr.handleMissingSamples(block)...)
+	switch frameType := block.frames[0].frameType; {
+	case frameType == AMR_SPEECH_LOST:
+		amr.dtx.lost(amr.samplesPerFrame())
+	case amr.getModeName(frameType) == "":
+		// SID and NO_DATA
+		amr.dtx.sid(amr.samplesPerFrame())
+	default:
+		amr.dtx.speech(amr.samplesPerFrame())
+	}
+	for _, frame := range block.frames {
+		if frame.hasCrc && !amr.verifyCrc(frame) {
+			log.Swarn("amr, crc mismatch, frame timestamp:%d marked as bad", block.timestamp)
+			frame.quality = false
+			amr.corruptedFrames++
 		}
+		result = append(result, frame.storageFormat()...)
+	}
+	amr.frames += len(block.frames)
+	amr.timestamp = block.timestamp
+	amr.started = true
+	return result
+}
+
+// handleMissingSamples fills DTX periods with NO_DATA frames, so decoders keep
+// generating comfort noise from the last SID, and lost speech with SPEECH_LOST.
+// SPEECH_LOST is reserved in AMR-NB, RFC 4867 table 1a, lost NB speech is NO_DATA too
+func (amr *Amr) handleMissingSamples(block amrFrameBlock) (result []byte) {
+	if !amr.started {
+		return nil
+	}
+	missing := int((block.timestamp-amr.timestamp)/uint32(amr.samplesPerFrame())) - 1
+	if missing <= 0 {
+		return nil
+	}
+
+	filler := amrFrame{frameType: AMR_NO_DATA, quality: true}
+	dtx := amr.dtx.gap(missing*amr.samplesPerFrame(), block.talkspurt)
+	if !dtx {
+		amr.lostFrames += missing * amr.channels
+		if amr.isWideBand() {
+			filler.frameType = AMR_SPEECH_LOST
+		}
+	}
+	log.Sdebug("amr, missing frames: %d, time: %d, dtx: %t", missing, missing*20, dtx)
+
+	for i := 0; i < missing*amr.channels; i++ {
+		result = append(result, filler.storageFormat()...)
 	}
 	return result
 }
@@ -126,116 +381,257 @@ func (amr *Amr) getSpeechFrameByteSize(frameType int) (size int) {
 	return
 }
 
-func (amr *Amr) handleOaMode(timestamp uint32, payload []byte) ([]byte, error) {
+func (amr *Amr) getSpeechFrameBitSize(frameType int) (size int) {
+	if amr.isWideBand() {
+		size = AMR_WB_FRAME_BITS[frameType]
+	} else {
+		size = AMR_NB_FRAME_BITS[frameType]
+	}
+	return
+}
+
+func (amr *Amr) getClassABitSize(frameType int) (size int) {
+	if amr.isWideBand() {
+		size = AMR_WB_CLASS_A_BITS[frameType]
+	} else {
+		size = AMR_NB_CLASS_A_BITS[frameType]
+	}
+	return
+}
 
-	var result []byte
-	var currentTimestamp uint32
+// verifyCrc checks the 8 bit CRC over class A bits, g(x) = 1 + x^2 + x^3 + x^4 + x^8
+func (amr *Amr) verifyCrc(frame amrFrame) bool {
+	var crc byte
+	bits := amr.getClassABitSize(frame.frameType)
+	for i := 0; i < bits && i/8 < len(frame.speech); i++ {
+		bit := (frame.speech[i/8] >> (7 - uint(i%8))) & 0x01
+		feedback := (crc >> 7) ^ bit
+		crc = crc << 1
+		if feedback == 0x01 {
+			crc = crc ^ 0x1D
+		}
+	}
+	return crc == frame.crc
+}
 
-	frame := 0
-	rtpFrameHeader := payload[0:]
+func (amr *Amr) handleOaMode(payload []byte) (*amrPayload, error) {
 	// payload header := [CMR(4bit)[R(4bit)][ILL(4bit)(opt)][ILP(4bit)(opt)]
 	// TOC := [F][FT(4bit)][Q][P][P]
+	// CRC := [CRC(8bit)](opt) per speech frame
 	// storage := [0][FT(4bit)][Q][0][0]
-	cmr := (rtpFrameHeader[0] & 0xF0) >> 4
-	isLastFrame := (rtpFrameHeader[1]&0x80)&0x80 == 0x00
-	frameType := (rtpFrameHeader[1] & 0x78) >> 3
-	quality := (rtpFrameHeader[1]&0x04)&0x04 == 0x04
+	if len(payload) < 2 {
+		return nil, errors.New("Amr payload too short")
+	}
 
-	log.Sdebug("octet-aligned, lastFrame:%t, cmr:%d, frameType:%d, quality:%t",
-		isLastFrame, cmr, frameType, quality)
+	result := &amrPayload{cmr: int(payload[0]&0xF0) >> 4}
+	offset := 1
 
-	speechFrameHeader := frameType << 3
-	speechFrameHeader = speechFrameHeader | (rtpFrameHeader[1] & 0x04)
+	if amr.interleaving {
+		result.ill = int(payload[offset]&0xF0) >> 4
+		result.ilp = int(payload[offset] & 0x0F)
+		offset++
+		if result.ilp > result.ill {
+			return nil, errors.New("Amr ILP greater than ILL")
+		}
+	}
 
-	speechFrameSize := amr.getSpeechFrameByteSize(int(frameType))
+	for isLastFrame := false; !isLastFrame; offset++ {
+		if offset >= len(payload) {
+			return nil, errors.New("Amr payload too short for table of contents")
+		}
+		toc := payload[offset]
+		isLastFrame = toc&0x80 == 0x00
+		frame := amrFrame{
+			frameType: int(toc&0x78) >> 3,
+			quality:   toc&0x04 == 0x04,
+		}
 
-	currentTimestamp = timestamp + uint32((amr.sampleRate/50)*frame)
+		log.Sdebug("octet-aligned, lastFrame:%t, cmr:%d, frameType:%d, quality:%t",
+			isLastFrame, result.cmr, frame.frameType, frame.quality)
 
-	if !isLastFrame {
-		log.Warn("Amr does not suport more than one frame per payload - discarted")
-		return nil, errors.New("Amr does not suport more than one frame per payload")
+		result.frames = append(result.frames, frame)
 	}
 
-	result = append(result, speechFrameHeader)
+	if amr.crc {
+		for i := range result.frames {
+			if amr.getSpeechFrameBitSize(result.frames[i].frameType) == 0 {
+				continue
+			}
+			if offset >= len(payload) {
+				return nil, errors.New("Amr payload too short for frame CRCs")
+			}
+			result.frames[i].hasCrc = true
+			result.frames[i].crc = payload[offset]
+			offset++
+		}
+	}
 
-	if speechFrameSize != 0 {
-		speechPayload := rtpFrameHeader[2 : 2+speechFrameSize]
-		result = append(result, speechPayload...)
+	speechSize := 0
+	for i := range result.frames {
+		speechFrameSize := amr.getSpeechFrameByteSize(result.frames[i].frameType)
+		result.frames[i].speech = make([]byte, speechFrameSize)
+		speechSize += speechFrameSize
+	}
+	if offset+speechSize > len(payload) {
+		return nil, errors.New("Amr payload too short for speech frames")
+	}
+
+	if amr.robustSorting {
+		// octets are sorted by sensitivity: first octet of every frame, then second...
+		for k := 0; offset < len(payload) && speechSize > 0; k++ {
+			for i := range result.frames {
+				if k < len(result.frames[i].speech) {
+					result.frames[i].speech[k] = payload[offset]
+					offset++
+					speechSize--
+				}
+			}
+		}
+	} else {
+		for i := range result.frames {
+			offset += copy(result.frames[i].speech, payload[offset:])
+		}
 	}
-	amr.timestamp = currentTimestamp
 	return result, nil
 }
 
-func (amr *Amr) handleBeMode(timestamp uint32, payload []byte) ([]byte, error) {
-	var result []byte
-	var currentTimestamp uint32
-
-	frame := 0
-	rtpFrameHeader := payload[0:]
+func (amr *Amr) handleBeMode(payload []byte) (*amrPayload, error) {
 	// packing frame with TOC: frame type and quality bit
-	// RTP=[CMR(4bit)[F][FT(4bit)][Q][..speechFrame]] -> storage=[0][FT(4bit)][Q][0][0]
-	cmr := (rtpFrameHeader[0] & 0xF0) >> 4
-	isLastFrame := (rtpFrameHeader[0]&0x08)>>3 == 0x00
-	frameType := (rtpFrameHeader[0]&0x07)<<1 | (rtpFrameHeader[1]&0x80)>>7
-	quality := (rtpFrameHeader[1] & 0x40) == 0x40
-
-	log.Sdebug("bandwidth-efficient, lastFrame:%t, cmr:%d, frameType:%d, quality:%t",
-		isLastFrame, cmr, frameType, quality)
+	// RTP=[CMR(4bit)[F][FT(4bit)][Q]..[F][FT(4bit)][Q][..speechFrames]]
+	// storage=[0][FT(4bit)][Q][0][0]
+	reader := newBitReader(payload)
 
-	speechFrameHeader := (rtpFrameHeader[0]&0x07)<<4 | (rtpFrameHeader[1]&0x80)>>4
-	speechFrameHeader = speechFrameHeader | (rtpFrameHeader[1]&0x40)>>4
+	cmr, err := reader.readBits(4)
+	if err != nil {
+		return nil, errors.New("Amr payload too short")
+	}
 
-	speechFrameSize := amr.getSpeechFrameByteSize(int(frameType))
+	result := &amrPayload{cmr: int(cmr)}
+	for isLastFrame := false; !isLastFrame; {
+		toc, err := reader.readBits(6)
+		if err != nil {
+			return nil, errors.New("Amr payload too short for table of contents")
+		}
+		isLastFrame = toc&0x20 == 0x00
+		frame := amrFrame{
+			frameType: int(toc&0x1E) >> 1,
+			quality:   toc&0x01 == 0x01,
+		}
 
-	currentTimestamp = timestamp + uint32((amr.sampleRate/50)*frame)
+		log.Sdebug("bandwidth-efficient, lastFrame:%t, cmr:%d, frameType:%d, quality:%t",
+			isLastFrame, cmr, frame.frameType, frame.quality)
 
-	if !isLastFrame {
-		log.Warn("Amr does not suport more than one frame per payload - discarted")
-		return nil, errors.New("Amr does not suport more than one frame per payload")
+		result.frames = append(result.frames, frame)
 	}
 
-	result = append(result, speechFrameHeader)
-
-	if speechFrameSize != 0 {
-		speechPayload := rtpFrameHeader[1:]
-		speechFrame := make([]byte, speechFrameSize)
-		// shift 2 bits left in speechFrame
-		for k := 0; k < speechFrameSize; k++ {
-			speechFrame[k] = (speechPayload[k] & 0x3F) << 2
-			if k+1 < speechFrameSize {
-				speechFrame[k] = speechFrame[k] | (speechPayload[k+1]&0xC0)>>6
-			}
+	// speech bits are not octet aligned, left align each frame in storage
+	for i := range result.frames {
+		speech, err := reader.readAligned(amr.getSpeechFrameBitSize(result.frames[i].frameType))
+		if err != nil {
+			return nil, errors.New("Amr payload too short for speech frames")
 		}
-		result = append(result, speechFrame...)
+		result.frames[i].speech = speech
 	}
-	amr.timestamp = currentTimestamp
 	return result, nil
 }
 
+type amrPayload struct {
+	cmr    int
+	ill    int
+	ilp    int
+	frames []amrFrame
+}
+
+type amrFrameBlock struct {
+	timestamp uint32
+	frames    []amrFrame
+	talkspurt bool
+}
+
+type amrFrame struct {
+	frameType int
+	quality   bool
+	hasCrc    bool
+	crc       byte
+	speech    []byte
+}
+
+func (f amrFrame) storageFormat() []byte {
+	header := byte(f.frameType) << 3
+	if f.quality {
+		header = header | 0x04
+	}
+	return append([]byte{header}, f.speech...)
+}
+
 var AmrMetadata = CodecMetadata{
 	Name:     "amr",
 	LongName: "Adaptative Multi Rate",
 	Options: []CodecOption{
 		amrSampleRateOption,
 		amrOctetAlignedOption,
+		amrChannelsOption,
+		amrCrcOption,
+		amrRobustSortingOption,
+		amrInterleavingOption,
+		amrFmtpOption,
 	},
 	Init: NewAmr,
 }
 
 var amrOctetAlignedOption = CodecOption{
-	Required:         true,
+	Required:         false,
 	Name:             "octet-aligned",
-	Description:      "whether this payload is octet-aligned or bandwidth-efficient",
+	Description:      "whether this payload is octet-aligned or bandwidth-efficient, empty to auto-detect",
 	ValidValues:      []string{"0", "1"},
 	ValueDescription: []string{"bandwidth-efficient", "octet-aligned"},
 	RestrictValues:   true,
 }
 
 var amrSampleRateOption = CodecOption{
-	Required:         true,
+	Required:         false,
 	Name:             "sample-rate",
-	Description:      "whether this payload is narrow or wide band",
+	Description:      "whether this payload is narrow or wide band, empty to auto-detect",
 	ValidValues:      []string{"nb", "wb"},
 	ValueDescription: []string{"Narrow Band (8000)", "Wide Band (16000)"},
 	RestrictValues:   true,
 }
+
+var amrChannelsOption = CodecOption{
+	Required:       false,
+	Name:           "channels",
+	Description:    "number of audio channels in rtpmap, empty for 1",
+	RestrictValues: false,
+}
+
+var amrCrcOption = CodecOption{
+	Required:         false,
+	Name:             "crc",
+	Description:      "whether frame CRCs are present, octet-aligned only",
+	ValidValues:      []string{"0", "1"},
+	ValueDescription: []string{"no CRC", "CRC present"},
+	RestrictValues:   true,
+}
+
+var amrRobustSortingOption = CodecOption{
+	Required:         false,
+	Name:             "robust-sorting",
+	Description:      "whether speech frames are robust sorted, octet-aligned only",
+	ValidValues:      []string{"0", "1"},
+	ValueDescription: []string{"simple payload sorting", "robust payload sorting"},
+	RestrictValues:   true,
+}
+
+var amrInterleavingOption = CodecOption{
+	Required:       false,
+	Name:           "interleaving",
+	Description:    "maximum frame-blocks per interleaving group, empty if not interleaved",
+	RestrictValues: false,
+}
+
+var amrFmtpOption = CodecOption{
+	Required:       false,
+	Name:           "fmtp",
+	Description:    "a=fmtp parameters, used for options left empty",
+	RestrictValues: false,
+}
@@ -0,0 +1,159 @@
+package codecs
+
+import (
+	"fmt"
+
+	"github.com/hdiniz/rtpdump/log"
+	"github.com/hdiniz/rtpdump/rtp"
+)
+
+// number of packets inspected before deciding the AMR flavor
+const AMR_DETECT_PACKETS = 10
+
+var AMR_NB_VALID_CMR = []bool{true, true, true, true, true, true, true, true, false, false, false, false, false, false, false, true}
+var AMR_WB_VALID_CMR = []bool{true, true, true, true, true, true, true, true, true, false, false, false, false, false, false, true}
+var AMR_NB_VALID_FRAME_TYPE = []bool{true, true, true, true, true, true, true, true, true, false, false, false, false, false, false, true}
+var AMR_WB_VALID_FRAME_TYPE = []bool{true, true, true, true, true, true, true, true, true, true, false, false, false, false, true, true}
+
+type amrFlavor struct {
+	sampleRate   int
+	octetAligned bool
+}
+
+func (f amrFlavor) String() string {
+	band := "nb"
+	if f.sampleRate == AMR_WB_SAMPLE_RATE {
+		band = "wb"
+	}
+	if f.octetAligned {
+		return band + " octet-aligned"
+	}
+	return band + " bandwidth-efficient"
+}
+
+func (amr *Amr) isDetecting() bool {
+	return (amr.autoSampleRate || amr.autoOctetAligned) && !amr.detected
+}
+
+// detectFlavor decides the flavor from buffered packets and handles them
+func (amr *Amr) detectFlavor() (result []byte) {
+	var candidates []amrFlavor
+	for _, sampleRate := range []int{AMR_WB_SAMPLE_RATE, AMR_NB_SAMPLE_RATE} {
+		if !amr.autoSampleRate && sampleRate != amr.sampleRate {
+			continue
+		}
+		for _, octetAligned := range []bool{false, true} {
+			if !amr.autoOctetAligned && octetAligned != amr.octetAligned {
+				continue
+			}
+			if !octetAligned && (amr.crc || amr.robustSorting || amr.interleaving) {
+				continue
+			}
+			candidates = append(candidates, amrFlavor{sampleRate, octetAligned})
+		}
+	}
+
+	best, second := -1, -1
+	var bestFlavor amrFlavor
+	for _, candidate := range candidates {
+		consistent := 0
+		for _, packet := range amr.detectBuffer {
+			if amr.isConsistent(candidate, packet.Payload) {
+				consistent++
+			}
+		}
+		log.Sdebug("amr auto-detect, %s: %d/%d consistent packets", candidate, consistent, len(amr.detectBuffer))
+		if consistent > best {
+			second = best
+			best = consistent
+			bestFlavor = candidate
+		} else if consistent > second {
+			second = consistent
+		}
+	}
+	if second < 0 {
+		second = 0
+	}
+
+	amr.sampleRate = bestFlavor.sampleRate
+	amr.octetAligned = bestFlavor.octetAligned
+	amr.detected = true
+	amr.detectConfidence = float64(best-second) / float64(len(amr.detectBuffer))
+	amr.detection = fmt.Sprintf("%s, confidence %.0f%% (%d packets)",
+		bestFlavor, amr.detectConfidence*100, len(amr.detectBuffer))
+	log.Sinfo("amr auto-detect: %s", amr.detection)
+
+	result = append(result, amr.GetFormatMagic()...)
+	packets := amr.detectBuffer
+	amr.detectBuffer = nil
+	for _, packet := range packets {
+		frames, err := amr.HandleRtpPacket(packet)
+		if err == nil {
+			result = append(result, frames...)
+		}
+	}
+	return result
+}
+
+// isConsistent checks if payload parses exactly with the given flavor
+func (amr *Amr) isConsistent(flavor amrFlavor, payload []byte) bool {
+	trial := *amr
+	trial.sampleRate = flavor.sampleRate
+	trial.octetAligned = flavor.octetAligned
+
+	validCmr, validFrameType := AMR_NB_VALID_CMR, AMR_NB_VALID_FRAME_TYPE
+	if trial.isWideBand() {
+		validCmr, validFrameType = AMR_WB_VALID_CMR, AMR_WB_VALID_FRAME_TYPE
+	}
+
+	var p *amrPayload
+	var err error
+	if trial.octetAligned {
+		// reserved bits after CMR and TOC padding bits are zero
+		if len(payload) > 0 && payload[0]&0x0F != 0 {
+			return false
+		}
+		p, err = trial.handleOaMode(payload)
+	} else {
+		p, err = trial.handleBeMode(payload)
+	}
+	if err != nil || !validCmr[p.cmr] {
+		return false
+	}
+
+	bits := 0
+	for _, frame := range p.frames {
+		if !validFrameType[frame.frameType] {
+			return false
+		}
+		bits += trial.getSpeechFrameBitSize(frame.frameType)
+	}
+
+	if !trial.octetAligned {
+		return (4+6*len(p.frames)+bits+7)/8 == len(payload)
+	}
+
+	size := 1 + len(p.frames)
+	if trial.interleaving {
+		size++
+	}
+	tocOffset := size - len(p.frames)
+	for i, frame := range p.frames {
+		if payload[tocOffset+i]&0x03 != 0 {
+			return false
+		}
+		if frame.hasCrc {
+			size++
+		}
+		size += len(frame.speech)
+	}
+	return size == len(payload)
+}
+
+func (amr *Amr) handleDetection(packet *rtp.RtpPacket) []byte {
+	amr.detectBuffer = append(amr.detectBuffer, packet)
+	if len(amr.detectBuffer) < AMR_DETECT_PACKETS {
+		return nil
+	}
+	return amr.detectFlavor()
+}
@@ -0,0 +1,60 @@
+package codecs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hdiniz/rtpdump/rtp"
+)
+
+// testAmrCrc computes the frame CRC bit by bit, 3GPP TS 26.101 4.1.4
+func testAmrCrc(speech []byte, bits int) (crc byte) {
+	for i := 0; i < bits; i++ {
+		bit := speech[i/8] >> (7 - uint(i%8)) & 0x01
+		feedback := crc>>7 ^ bit
+		crc <<= 1
+		if feedback == 0x01 {
+			crc ^= 0x1D
+		}
+	}
+	return crc
+}
+
+func TestAmrCrcRobustSorting(t *testing.T) {
+	// two AMR-NB SID frames, 39 class A bits in 5 octets
+	a := []byte{0x12, 0x34, 0x56, 0x78, 0x9A}
+	b := []byte{0xBC, 0xDE, 0xF0, 0x0F, 0xED}
+
+	tests := []struct {
+		name     string
+		crcB     byte
+		expected []byte
+	}{
+		{"valid crc", testAmrCrc(b, 39), append(append([]byte{0x44}, a...), append([]byte{0x44}, b...)...)},
+		{"crc mismatch", testAmrCrc(b, 39) ^ 0x01, append(append([]byte{0x44}, a...), append([]byte{0x40}, b...)...)},
+	}
+
+	for _, test := range tests {
+		c := NewAmr()
+		if err := c.SetOptions(map[string]string{
+			"sample-rate": "nb",
+			"fmtp":        "octet-align=1; crc=1; robust-sorting=1",
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// CMR, TOC, CRCs, then speech octets sorted across frames
+		payload := []byte{0xF0, 0xC4, 0x44, testAmrCrc(a, 39), test.crcB}
+		for i := range a {
+			payload = append(payload, a[i], b[i])
+		}
+
+		result, err := c.HandleRtpPacket(&rtp.RtpPacket{SequenceNumber: 1, Timestamp: 160, Payload: payload})
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if !bytes.Equal(result, test.expected) {
+			t.Errorf("%s: got % X, expected % X", test.name, result, test.expected)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package codecs
 
 import (
   "fmt"
+  "strings"
   "github.com/hdiniz/rtpdump/rtp"
 )
 
@@ -12,6 +13,18 @@ type Codec interface {
   GetFormatMagic() []byte
 }
 
+// MetadataWriter is implemented by codecs producing side information
+// that does not fit in the dumped media file, written alongside it.
+// Metadata is keyed by the extension appended to the dump file name
+type MetadataWriter interface {
+  GetMetadata() map[string][]byte
+}
+
+// Analyzer is implemented by codecs able to report on the handled stream
+type Analyzer interface {
+  GetAnalysis() string
+}
+
 type CodecMetadata struct {
   Name string
   LongName string
@@ -28,6 +41,41 @@ type CodecOption struct {
   RestrictValues bool
 }
 
+// Flusher is implemented by codecs buffering frames for reordering,
+// remaining frames are returned once the stream ends
+type Flusher interface {
+  Flush() []byte
+}
+
+// EmptyPayloadHandler is implemented by codecs for which an empty payload carries
+// meaning, empty RED blocks are then recovered for them instead of being skipped
+type EmptyPayloadHandler interface {
+  HandlesEmptyPayload() bool
+}
+
+// FormatMagicFinalizer is implemented by codecs whose format magic depends on
+// the dumped data, it is written again over the initial magic once done
+type FormatMagicFinalizer interface {
+  GetFinalFormatMagic() []byte
+}
+
+// ParseFmtp splits a=fmtp parameters such as "octet-align=1; crc=1"
+func ParseFmtp(fmtp string) map[string]string {
+  params := make(map[string]string)
+  for _, v := range strings.Split(fmtp, ";") {
+    kv := strings.SplitN(strings.TrimSpace(v), "=", 2)
+    if kv[0] == "" {
+      continue
+    }
+    if len(kv) == 2 {
+      params[kv[0]] = strings.TrimSpace(kv[1])
+    } else {
+      params[kv[0]] = ""
+    }
+  }
+  return params
+}
+
 func (m CodecMetadata) Describe() string {
   options := ""
   if len(m.Options) > 0 {
@@ -0,0 +1,52 @@
+package codecs
+
+import (
+	"errors"
+)
+
+type bitReader struct {
+	data   []byte
+	offset int
+}
+
+func newBitReader(data []byte) *bitReader {
+	return &bitReader{data: data}
+}
+
+func (r *bitReader) remaining() int {
+	return len(r.data)*8 - r.offset
+}
+
+func (r *bitReader) readBit() (uint, error) {
+	if r.remaining() < 1 {
+		return 0, errors.New("not enough bits left")
+	}
+	bit := uint(r.data[r.offset/8]>>(7-uint(r.offset%8))) & 0x01
+	r.offset++
+	return bit, nil
+}
+
+func (r *bitReader) readBits(n int) (uint, error) {
+	if r.remaining() < n {
+		return 0, errors.New("not enough bits left")
+	}
+	var value uint
+	for i := 0; i < n; i++ {
+		bit, _ := r.readBit()
+		value = value<<1 | bit
+	}
+	return value, nil
+}
+
+// readAligned reads n bits into a left aligned, zero padded byte slice
+func (r *bitReader) readAligned(n int) ([]byte, error) {
+	if r.remaining() < n {
+		return nil, errors.New("not enough bits left")
+	}
+	result := make([]byte, (n+7)/8)
+	for i := 0; i < n; i++ {
+		bit, _ := r.readBit()
+		result[i/8] = result[i/8] | byte(bit<<(7-uint(i%8)))
+	}
+	return result, nil
+}
@@ -2,5 +2,23 @@ package codecs
 
 var CodecList = []CodecMetadata{
   AmrMetadata,
+  EvsMetadata,
   H264Metadata,
+  PcmuMetadata,
+  PcmaMetadata,
+  L16Metadata,
+  L24Metadata,
+  G722Metadata,
+  OpusMetadata,
+  G729Metadata,
+  IlbcMetadata,
+  GsmMetadata,
+  H265Metadata,
+  H263Metadata,
+  H263PlusMetadata,
+  Vp8Metadata,
+  Vp9Metadata,
+  T140Metadata,
+  Mp2tMetadata,
+  AacMetadata,
 }
@@ -0,0 +1,108 @@
+package codecs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hdiniz/rtpdump/log"
+	"github.com/hdiniz/rtpdump/rtp"
+	"github.com/hdiniz/rtpdump/util"
+)
+
+// Coordination of Video Orientation - 3GPP TS 26.114 section 7.4.5
+// RTP header extension urn:3gpp:video-orientation := [0][0][0][0][C][F][R1][R0]
+
+const CVO_METADATA_EXTENSION = ".cvo"
+
+type videoOrientation struct {
+	backCamera bool
+	flip       bool
+	rotation   int
+}
+
+func (o videoOrientation) String() string {
+	camera := "front"
+	if o.backCamera {
+		camera = "back"
+	}
+	return fmt.Sprintf("rotation:%d, flip:%t, camera:%s", o.rotation, o.flip, camera)
+}
+
+type videoOrientationChange struct {
+	receivedAt     time.Time
+	sequenceNumber uint16
+	timestamp      uint32
+	orientation    videoOrientation
+}
+
+func (c videoOrientationChange) String() string {
+	return fmt.Sprintf("%s - %d - %d - %s",
+		util.TimeMsToStr(c.receivedAt),
+		c.sequenceNumber,
+		c.timestamp,
+		c.orientation,
+	)
+}
+
+type cvoTracker struct {
+	extensionId int
+	current     *videoOrientation
+	changes     []videoOrientationChange
+}
+
+func (t *cvoTracker) enabled() bool {
+	return t.extensionId > 0
+}
+
+func (t *cvoTracker) handleRtpPacket(packet *rtp.RtpPacket) {
+	if !t.enabled() {
+		return
+	}
+
+	element, ok := packet.GetExtensionElement(t.extensionId)
+	if !ok || len(element) < 1 {
+		return
+	}
+
+	orientation := videoOrientation{
+		backCamera: element[0]&0x08 == 0x08,
+		flip:       element[0]&0x04 == 0x04,
+		rotation:   int(element[0]&0x03) * 90,
+	}
+
+	if t.current != nil && *t.current == orientation {
+		return
+	}
+
+	log.Sdebug("cvo, seq:%d, %s", packet.SequenceNumber, orientation)
+
+	t.current = &orientation
+	t.changes = append(t.changes, videoOrientationChange{
+		receivedAt:     packet.ReceivedAt,
+		sequenceNumber: packet.SequenceNumber,
+		timestamp:      packet.Timestamp,
+		orientation:    orientation,
+	})
+}
+
+func (t *cvoTracker) metadata() []byte {
+	var result []byte
+	for _, v := range t.changes {
+		result = append(result, []byte(v.String()+"\n")...)
+	}
+	return result
+}
+
+func (t *cvoTracker) analysis() string {
+	if !t.enabled() {
+		return "Video orientation: not negotiated\n"
+	}
+	if len(t.changes) == 0 {
+		return "Video orientation: no CVO information found\n"
+	}
+	result := fmt.Sprintf("Video orientation changes: %d\n", len(t.changes))
+	for _, v := range t.changes {
+		result += fmt.Sprintf("\t%s\n", v)
+	}
+	return result
+}
@@ -0,0 +1,60 @@
+package codecs
+
+import (
+	"fmt"
+)
+
+// dtxTracker tells discontinuous transmission apart from packet loss.
+// A timestamp gap is silence when a SID or comfort noise frame came before it,
+// or when the marker bit flags the following packet as the start of a talkspurt
+type dtxTracker struct {
+	silent     bool
+	talkspurts int
+
+	speechSamples  int
+	silenceSamples int
+	lostSamples    int
+}
+
+// gap classifies samples missing before a frame, returns true for DTX
+func (t *dtxTracker) gap(samples int, talkspurt bool) bool {
+	if t.silent || talkspurt {
+		t.silent = true
+		t.silenceSamples += samples
+		return true
+	}
+	t.lostSamples += samples
+	return false
+}
+
+// speech records a speech frame, the first one after silence starts a talkspurt
+func (t *dtxTracker) speech(samples int) {
+	if t.silent || t.talkspurts == 0 {
+		t.talkspurts++
+	}
+	t.silent = false
+	t.speechSamples += samples
+}
+
+// sid records a SID, comfort noise or no data frame
+func (t *dtxTracker) sid(samples int) {
+	t.silent = true
+	t.silenceSamples += samples
+}
+
+// lost records a frame received as lost, such as AMR SPEECH_LOST
+func (t *dtxTracker) lost(samples int) {
+	t.lostSamples += samples
+}
+
+func (t *dtxTracker) analysis(sampleRate int) string {
+	ms := func(samples int) int {
+		return int(int64(samples) * 1000 / int64(sampleRate))
+	}
+	ratio := 0.0
+	if t.speechSamples+t.silenceSamples > 0 {
+		ratio = float64(t.silenceSamples) * 100 / float64(t.speechSamples+t.silenceSamples)
+	}
+	return fmt.Sprintf("Talkspurts: %d\nSpeech: %d ms\nSilence (DTX): %d ms\nLost: %d ms\nSilence ratio: %.1f%%\n",
+		t.talkspurts, ms(t.speechSamples), ms(t.silenceSamples), ms(t.lostSamples), ratio)
+}
@@ -0,0 +1,454 @@
+package codecs
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hdiniz/rtpdump/log"
+	"github.com/hdiniz/rtpdump/rtp"
+)
+
+const EVS_MAGIC string = "#!EVS_MC1.0\n"
+
+const EVS_SAMPLE_RATE = 16000
+
+// EVS primary frame sizes in bits, indexed by bitrate index
+// 2.8(PPP/NELP), 7.2, 8.0, 9.6, 13.2, 16.4, 24.4, 32, 48, 64, 96, 128, SID
+var EVS_PRIMARY_FRAME_BITS []int = []int{56, 144, 160, 192, 264, 328, 488, 640, 960, 1280, 1920, 2560, 48, 0, 0, 0}
+
+// EVS_AMRWB_IO_FRAME_BITS are the AMR-WB interoperable mode frame sizes in bits
+var EVS_AMRWB_IO_FRAME_BITS []int = AMR_WB_FRAME_BITS
+
+// channel-aware mode frames are sent with the 13.2 frame type, the partial copy of an earlier
+// frame is signalled in their last bits := [RF FEC offset(2)][RF frame type(3)]
+const EVS_13K2_FRAME_TYPE = 4
+
+// RF frame types, the kind of partial copy carried, none for RF_NO_DATA
+var EVS_RF_FRAME_TYPE_NAMES []string = []string{"no data", "TCX FD", "TCX TD1", "TCX TD2", "all pred", "no pred", "gen pred", "NELP"}
+
+// RF FEC offset code to the distance in frames of the frame copied
+var EVS_RF_FEC_OFFSETS []int = []int{2, 3, 5, 7}
+
+const EVS_SPEECH_LOST = 14
+const EVS_NO_DATA = 15
+
+// header-full CMR := [H=1][T(3bit)][D(4bit)]
+var EVS_CMR_BANDWIDTH []string = []string{"", "NB", "WB", "SWB", "FB", "WB", "SWB", ""}
+var EVS_CMR_RATE_NAMES []string = []string{"5.9", "7.2", "8.0", "9.6", "13.2", "16.4", "24.4", "32", "48", "64", "96", "128"}
+var EVS_CMR_CA_NAMES []string = []string{"CA-LO-2", "CA-LO-3", "CA-LO-5", "CA-LO-7", "CA-HI-2", "CA-HI-3", "CA-HI-5", "CA-HI-7"}
+
+// compact AMR-WB IO CMR(3bit) to AMR-WB IO frame type, 7 is no request
+var EVS_COMPACT_CMR_MODE []int = []int{0, 1, 2, 4, 5, 7, 8}
+
+// compact format payload sizes are unique, payload size defines the frame type
+type evsCompactFrame struct {
+	ioMode    bool
+	frameType int
+}
+
+var evsCompactSizes map[int]evsCompactFrame
+
+func init() {
+	evsCompactSizes = make(map[int]evsCompactFrame)
+	for ft, bits := range EVS_PRIMARY_FRAME_BITS {
+		if bits > 0 {
+			evsCompactSizes[bits/8] = evsCompactFrame{ioMode: false, frameType: ft}
+		}
+	}
+	// AMR-WB IO compact := [CMR(3bit)][speech bits][padding], SID is header-full only
+	for ft := 0; ft <= 8; ft++ {
+		evsCompactSizes[(EVS_AMRWB_IO_FRAME_BITS[ft]+3+7)/8] = evsCompactFrame{ioMode: true, frameType: ft}
+	}
+}
+
+type Evs struct {
+	started    bool
+	configured bool
+	hfOnly     bool
+	ioMode     bool
+	timestamp  uint32
+
+	frames          int
+	lostFrames      int
+	redundantFrames int
+
+	modes      modeTracker
+	caRequests int
+	dtx        dtxTracker
+
+	// channel-aware mode, ch-aw-recv offset, RF fields of 13.2 frames read once known to be in use
+	caOffset     int
+	speechFrames int
+	frames13k2   int
+	rfFrameTypes [8]int
+	rfOffsets    [4]int
+}
+
+func NewEvs() Codec {
+	return &Evs{started: false, configured: false, timestamp: 0}
+}
+
+func (evs *Evs) Init() {
+}
+
+func (evs Evs) GetFormatMagic() []byte {
+	// single channel description field follows magic
+	return append([]byte(EVS_MAGIC), 0x00, 0x00, 0x00, 0x01)
+}
+
+func (evs *Evs) invalidState() error {
+	return errors.New("invalid state")
+}
+
+func (evs *Evs) SetOptions(options map[string]string) (err error) {
+	if evs.started {
+		return evs.invalidState()
+	}
+
+	fmtp := ParseFmtp(options["fmtp"])
+	option := func(name string) (string, bool) {
+		if v, ok := options[name]; ok {
+			return v, ok
+		}
+		v, ok := fmtp[name]
+		return v, ok
+	}
+
+	v, _ := option("hf-only")
+	evs.hfOnly = v == "1"
+
+	// session starts in AMR-WB IO mode when evs-mode-switch is set
+	v, _ = option("evs-mode-switch")
+	evs.ioMode = v == "1"
+
+	// ch-aw-recv above 0 is the partial copy offset the receiver asks for from the start
+	if v, ok := fmtp["ch-aw-recv"]; ok {
+		if evs.caOffset, err = strconv.Atoi(v); err != nil {
+			return errors.New("invalid ch-aw-recv")
+		}
+	}
+
+	evs.configured = true
+	return nil
+}
+
+func (evs *Evs) HandleRtpPacket(packet *rtp.RtpPacket) (result []byte, err error) {
+	if !evs.configured {
+		return nil, evs.invalidState()
+	}
+
+	var payload *evsPayload
+	if _, compact := evsCompactSizes[len(packet.Payload)]; compact && !evs.hfOnly {
+		payload, err = evs.handleCompactFormat(packet.Payload)
+	} else {
+		payload, err = evs.handleHeaderFullFormat(packet.Payload)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	evs.handleCmr(packet, payload)
+
+	// RTP timestamp refers to the first frame, following frames are consecutive 20ms blocks
+	for i, frame := range payload.frames {
+		frameTimestamp := packet.Timestamp + uint32(evs.samplesPerFrame()*i)
+
+		if mode := frame.getModeName(); mode != "" {
+			evs.modes.frame(packet, frameTimestamp, mode)
+		}
+
+		if evs.started && int32(frameTimestamp-evs.timestamp) <= 0 {
+			log.Sdebug("evs, redundant frame, timestamp:%d already written", frameTimestamp)
+			evs.redundantFrames++
+			continue
+		}
+
+		result = append(result, evs.handleMissingSamples(frameTimestamp, packet.Marker && i == 0)...)
+		switch {
+		case frame.frameType == EVS_SPEECH_LOST:
+			evs.dtx.lost(evs.samplesPerFrame())
+		case frame.getModeName() == "":
+			// SID and NO_DATA
+			evs.dtx.sid(evs.samplesPerFrame())
+		default:
+			evs.dtx.speech(evs.samplesPerFrame())
+		}
+		result = append(result, frame.storageFormat()...)
+		evs.frames++
+		evs.handleChannelAware(frame)
+		evs.ioMode = frame.ioMode
+		evs.timestamp = frameTimestamp
+		evs.started = true
+	}
+	return result, nil
+}
+
+func (evs *Evs) GetAnalysis() string {
+	return fmt.Sprintf(
+		"Frames: %d\nLost frames: %d\nRedundant frames: %d\nChannel-aware mode requests: %d\n",
+		evs.frames, evs.lostFrames, evs.redundantFrames, evs.caRequests) +
+		evs.channelAwareAnalysis() + evs.dtx.analysis(EVS_SAMPLE_RATE) + evs.modes.timeline()
+}
+
+// handleChannelAware reads the RF frame type and FEC offset of 13.2 primary frames
+func (evs *Evs) handleChannelAware(frame evsFrame) {
+	if frame.getModeName() == "" {
+		return
+	}
+	evs.speechFrames++
+	if frame.ioMode || frame.frameType != EVS_13K2_FRAME_TYPE || len(frame.speech) == 0 {
+		return
+	}
+	evs.frames13k2++
+	// 264 bits, the RF fields are the last 5 bits of the last octet
+	last := frame.speech[len(frame.speech)-1]
+	evs.rfFrameTypes[last&0x07]++
+	if last&0x07 != 0 {
+		evs.rfOffsets[last>>3&0x03]++
+	}
+}
+
+// channelAwareAnalysis reports partial copies once channel-aware mode is known to be in use,
+// from ch-aw-recv, channel-aware requests or a stream sent at 13.2 only
+func (evs *Evs) channelAwareAnalysis() string {
+	if evs.frames13k2 == 0 ||
+		evs.caOffset <= 0 && evs.caRequests == 0 && evs.frames13k2 != evs.speechFrames {
+		return "Channel-aware mode: not in use\n"
+	}
+	partial := evs.frames13k2 - evs.rfFrameTypes[0]
+	result := fmt.Sprintf("Channel-aware frames with partial copy: %d of %d 13.2 frames\n", partial, evs.frames13k2)
+	for i, v := range evs.rfOffsets {
+		if v > 0 {
+			result += fmt.Sprintf("\toffset %d: %d\n", EVS_RF_FEC_OFFSETS[i], v)
+		}
+	}
+	for i, v := range evs.rfFrameTypes[1:] {
+		if v > 0 {
+			result += fmt.Sprintf("\t%s: %d\n", EVS_RF_FRAME_TYPE_NAMES[i+1], v)
+		}
+	}
+	return result
+}
+
+func (evs *Evs) GetModeRequests() []ModeEvent {
+	return evs.modes.requests
+}
+
+func (evs *Evs) GetModeChanges() []ModeEvent {
+	return evs.modes.changes
+}
+
+func (evs *Evs) handleCmr(packet *rtp.RtpPacket, payload *evsPayload) {
+	if payload.cmr < 0 {
+		return
+	}
+
+	if payload.compact {
+		if payload.cmr >= len(EVS_COMPACT_CMR_MODE) {
+			evs.modes.request(packet, "", "")
+		} else {
+			evs.modes.request(packet, "AMR-WB "+AMR_WB_MODE_NAMES[EVS_COMPACT_CMR_MODE[payload.cmr]], "")
+		}
+		return
+	}
+
+	cmrType := (payload.cmr & 0x70) >> 4
+	cmrData := payload.cmr & 0x0F
+	switch {
+	case cmrType == 0 && cmrData < len(AMR_WB_MODE_NAMES):
+		evs.modes.request(packet, "AMR-WB "+AMR_WB_MODE_NAMES[cmrData], "")
+	case cmrType >= 1 && cmrType <= 4 && cmrData < len(EVS_CMR_RATE_NAMES):
+		evs.modes.request(packet, "EVS "+EVS_CMR_RATE_NAMES[cmrData], EVS_CMR_BANDWIDTH[cmrType])
+	case (cmrType == 5 || cmrType == 6) && cmrData < len(EVS_CMR_CA_NAMES):
+		// channel-aware mode only operates at 13.2
+		evs.caRequests++
+		evs.modes.request(packet, "EVS 13.2", EVS_CMR_BANDWIDTH[cmrType]+" "+EVS_CMR_CA_NAMES[cmrData])
+	case cmrType == 7 && cmrData == 15:
+		evs.modes.request(packet, "", "")
+	default:
+		log.Sdebug("evs, reserved cmr:%d", payload.cmr)
+	}
+}
+
+func (evs *Evs) samplesPerFrame() int {
+	return EVS_SAMPLE_RATE / 50
+}
+
+// handleMissingSamples fills DTX periods with NO_DATA frames and lost speech with SPEECH_LOST
+func (evs *Evs) handleMissingSamples(timestamp uint32, talkspurt bool) (result []byte) {
+	if !evs.started {
+		return nil
+	}
+	missing := int((timestamp-evs.timestamp)/uint32(evs.samplesPerFrame())) - 1
+	if missing <= 0 {
+		return nil
+	}
+
+	filler := evsFrame{ioMode: evs.ioMode, quality: true, frameType: EVS_SPEECH_LOST}
+	if evs.dtx.gap(missing*evs.samplesPerFrame(), talkspurt) {
+		filler.frameType = EVS_NO_DATA
+	} else {
+		evs.lostFrames += missing
+	}
+	log.Sdebug("evs, missing frames: %d, time: %d, dtx: %t", missing, missing*20, filler.frameType == EVS_NO_DATA)
+
+	for i := 0; i < missing; i++ {
+		result = append(result, filler.storageFormat()...)
+	}
+	return result
+}
+
+func (evs *Evs) getSpeechFrameBitSize(ioMode bool, frameType int) int {
+	if ioMode {
+		return EVS_AMRWB_IO_FRAME_BITS[frameType]
+	}
+	return EVS_PRIMARY_FRAME_BITS[frameType]
+}
+
+func (evs *Evs) handleCompactFormat(payload []byte) (*evsPayload, error) {
+	// EVS primary := [speech bits]
+	// AMR-WB IO := [CMR(3bit)][speech bits][padding]
+	compact := evsCompactSizes[len(payload)]
+	result := &evsPayload{compact: true, cmr: -1}
+	frame := evsFrame{ioMode: compact.ioMode, quality: true, frameType: compact.frameType}
+
+	log.Sdebug("evs, compact, ioMode:%t, frameType:%d", frame.ioMode, frame.frameType)
+
+	if !compact.ioMode {
+		frame.speech = payload
+		result.frames = append(result.frames, frame)
+		return result, nil
+	}
+
+	reader := newBitReader(payload)
+	cmr, _ := reader.readBits(3)
+	result.cmr = int(cmr)
+
+	speech, err := reader.readAligned(evs.getSpeechFrameBitSize(true, frame.frameType))
+	if err != nil {
+		return nil, errors.New("evs payload too short for speech frame")
+	}
+	frame.speech = speech
+	result.frames = append(result.frames, frame)
+	return result, nil
+}
+
+func (evs *Evs) handleHeaderFullFormat(payload []byte) (*evsPayload, error) {
+	// CMR := [H=1][T(3bit)][D(4bit)] (opt)
+	// ToC := [H=0][F][EVS mode][Q][FT(4bit)]
+	// storage := ToC with F=0 followed by octet aligned speech frame
+	if len(payload) < 1 {
+		return nil, errors.New("evs payload too short")
+	}
+
+	result := &evsPayload{cmr: -1}
+	offset := 0
+	if payload[0]&0x80 == 0x80 {
+		result.cmr = int(payload[0] & 0x7F)
+		offset++
+	}
+
+	for isLastFrame := false; !isLastFrame; offset++ {
+		if offset >= len(payload) {
+			return nil, errors.New("evs payload too short for table of contents")
+		}
+		toc := payload[offset]
+		if toc&0x80 == 0x80 {
+			return nil, errors.New("evs, unexpected header bit in table of contents")
+		}
+		isLastFrame = toc&0x40 == 0x00
+		frame := evsFrame{
+			ioMode:    toc&0x20 == 0x20,
+			quality:   toc&0x10 == 0x10,
+			frameType: int(toc & 0x0F),
+		}
+
+		log.Sdebug("evs, header-full, lastFrame:%t, cmr:%d, ioMode:%t, frameType:%d, quality:%t",
+			isLastFrame, result.cmr, frame.ioMode, frame.frameType, frame.quality)
+
+		result.frames = append(result.frames, frame)
+	}
+
+	for i := range result.frames {
+		speechFrameSize := (evs.getSpeechFrameBitSize(result.frames[i].ioMode, result.frames[i].frameType) + 7) / 8
+		if offset+speechFrameSize > len(payload) {
+			return nil, errors.New("evs payload too short for speech frames")
+		}
+		result.frames[i].speech = payload[offset : offset+speechFrameSize]
+		offset += speechFrameSize
+	}
+	return result, nil
+}
+
+type evsPayload struct {
+	compact bool
+	cmr     int
+	frames  []evsFrame
+}
+
+type evsFrame struct {
+	ioMode    bool
+	quality   bool
+	frameType int
+	speech    []byte
+}
+
+// getModeName names the speech mode, empty for SID, lost or no data frames
+func (f evsFrame) getModeName() string {
+	if f.ioMode && f.frameType < len(AMR_WB_MODE_NAMES) {
+		return "AMR-WB " + AMR_WB_MODE_NAMES[f.frameType]
+	}
+	if !f.ioMode && f.frameType < len(EVS_PRIMARY_MODE_NAMES) {
+		return "EVS " + EVS_PRIMARY_MODE_NAMES[f.frameType]
+	}
+	return ""
+}
+
+func (f evsFrame) storageFormat() []byte {
+	header := byte(f.frameType)
+	if f.ioMode {
+		header = header | 0x20
+		if f.quality {
+			header = header | 0x10
+		}
+	}
+	return append([]byte{header}, f.speech...)
+}
+
+var EvsMetadata = CodecMetadata{
+	Name:     "evs",
+	LongName: "Enhanced Voice Services",
+	Options: []CodecOption{
+		evsHfOnlyOption,
+		evsModeSwitchOption,
+		evsFmtpOption,
+	},
+	Init: NewEvs,
+}
+
+var evsHfOnlyOption = CodecOption{
+	Required:         false,
+	Name:             "hf-only",
+	Description:      "whether only header-full payload format is used",
+	ValidValues:      []string{"0", "1"},
+	ValueDescription: []string{"compact and header-full", "header-full only"},
+	RestrictValues:   true,
+}
+
+var evsModeSwitchOption = CodecOption{
+	Required:         false,
+	Name:             "evs-mode-switch",
+	Description:      "whether the session starts in EVS primary or AMR-WB IO mode",
+	ValidValues:      []string{"0", "1"},
+	ValueDescription: []string{"EVS primary", "AMR-WB IO"},
+	RestrictValues:   true,
+}
+
+var evsFmtpOption = CodecOption{
+	Required:       false,
+	Name:           "fmtp",
+	Description:    "a=fmtp parameters, used for options left empty",
+	RestrictValues: false,
+}
@@ -0,0 +1,363 @@
+package codecs
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/hdiniz/rtpdump/log"
+	"github.com/hdiniz/rtpdump/rtp"
+)
+
+const G711_SAMPLE_RATE = 8000
+
+const G711_ULAW_SILENCE = 0xFF
+const G711_ALAW_SILENCE = 0xD5
+
+// peak of a 0 dBm0 sine wave in 16 bit samples, ITU-T G.711 tables 5 and 6
+const G711_ULAW_0DBM0_PEAK = 22662
+const G711_ALAW_0DBM0_PEAK = 22827
+
+// RFC 3551 static payload type of comfort noise, RFC 3389
+const CN_PAYLOAD_TYPE = 13
+
+// CN noise level is in -dBov, -127 dBov is digital silence
+const CN_SILENCE_LEVEL = 127
+
+// gaps longer than this are treated as a timestamp discontinuity, not loss
+const G711_MAX_GAP_SAMPLES = G711_SAMPLE_RATE * 60
+
+type G711 struct {
+	started    bool
+	configured bool
+	aLaw       bool
+	linear     bool
+	timestamp  uint32
+
+	dataSize int
+
+	tones toneDetector
+
+	cnPayloadType int
+	noiseLevel    int
+	noise         *rand.Rand
+	dtx           dtxTracker
+}
+
+func NewPcmu() Codec {
+	return &G711{started: false, configured: false, aLaw: false}
+}
+
+func NewPcma() Codec {
+	return &G711{started: false, configured: false, aLaw: true}
+}
+
+func (g *G711) Init() {
+}
+
+func (g *G711) format() wavFormat {
+	if g.linear {
+		return wavFormat{WAVE_FORMAT_PCM, 1, G711_SAMPLE_RATE, 16}
+	}
+	if g.aLaw {
+		return wavFormat{WAVE_FORMAT_ALAW, 1, G711_SAMPLE_RATE, 8}
+	}
+	return wavFormat{WAVE_FORMAT_MULAW, 1, G711_SAMPLE_RATE, 8}
+}
+
+func (g G711) GetFormatMagic() []byte {
+	return g.format().header(g.dataSize)
+}
+
+// GetFinalFormatMagic returns the header with the size of all dumped samples
+func (g *G711) GetFinalFormatMagic() []byte {
+	return g.format().header(g.dataSize)
+}
+
+func (g *G711) invalidState() error {
+	return errors.New("invalid state")
+}
+
+func (g *G711) SetOptions(options map[string]string) error {
+	if g.started {
+		return g.invalidState()
+	}
+
+	v, ok := options["output"]
+	if !ok || v == "pcm" {
+		g.linear = true
+	} else if v == "g711" {
+		g.linear = false
+	} else {
+		return errors.New("invalid codec option value")
+	}
+
+	// test tone frequencies in Hz, such as "1004,2010"
+	var frequencies []float64
+	if v, ok := options["tones"]; ok {
+		for _, f := range strings.Split(v, ",") {
+			frequency, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+			if err != nil || frequency <= 0 || frequency >= G711_SAMPLE_RATE/2 {
+				return errors.New("invalid codec option value")
+			}
+			frequencies = append(frequencies, frequency)
+		}
+	}
+	referencePeak := G711_ULAW_0DBM0_PEAK
+	if g.aLaw {
+		referencePeak = G711_ALAW_0DBM0_PEAK
+	}
+	g.tones = newToneDetector(G711_SAMPLE_RATE, float64(referencePeak), frequencies)
+
+	g.cnPayloadType = CN_PAYLOAD_TYPE
+	if v, ok := options["cn-payload-type"]; ok {
+		payloadType, err := strconv.Atoi(v)
+		if err != nil || payloadType < 0 || payloadType > 127 {
+			return errors.New("invalid codec option value")
+		}
+		g.cnPayloadType = payloadType
+	}
+	g.noiseLevel = CN_SILENCE_LEVEL
+	g.noise = rand.New(rand.NewSource(1))
+
+	g.configured = true
+	return nil
+}
+
+func (g *G711) HandleRtpPacket(packet *rtp.RtpPacket) (result []byte, err error) {
+	if !g.configured {
+		return nil, g.invalidState()
+	}
+
+	if packet.PayloadType == g.cnPayloadType {
+		return nil, g.handleComfortNoise(packet)
+	}
+
+	// one byte per sample, ptime changes are followed by the payload size
+	payload := packet.Payload
+	if g.started {
+		gap := int32(packet.Timestamp - g.timestamp)
+		if gap < 0 {
+			if int(-gap) >= len(payload) {
+				return nil, errors.New("g711, samples already written")
+			}
+			payload = payload[-gap:]
+		} else if gap > G711_MAX_GAP_SAMPLES {
+			log.Swarn("g711, timestamp jump of %d samples, not filled", gap)
+		} else if gap > 0 && g.dtx.gap(int(gap), packet.Marker) {
+			log.Sdebug("g711, silence samples: %d, time: %d", gap, gap/(G711_SAMPLE_RATE/1000))
+			result = append(result, g.comfortNoise(packet, int(gap))...)
+		} else if gap > 0 {
+			log.Sdebug("g711, lost samples: %d, time: %d", gap, gap/(G711_SAMPLE_RATE/1000))
+			result = append(result, g.silence(int(gap))...)
+			g.tones.handleSamples(packet, make([]int16, gap))
+		}
+	}
+
+	g.dtx.speech(len(payload))
+	pcm := g.decode(payload)
+	g.tones.handleSamples(packet, pcm)
+	result = append(result, g.samples(payload, pcm)...)
+	g.timestamp = packet.Timestamp + uint32(len(packet.Payload))
+	g.started = true
+	g.dataSize += len(result)
+	return result, nil
+}
+
+// handleComfortNoise takes the noise level of a CN packet, RFC 3389
+// := [0][level(7bit)][spectral information(opt)]
+func (g *G711) handleComfortNoise(packet *rtp.RtpPacket) error {
+	if len(packet.Payload) < 1 {
+		return errors.New("comfort noise payload too short")
+	}
+	g.noiseLevel = int(packet.Payload[0] & 0x7F)
+	g.dtx.sid(0)
+	log.Sdebug("g711, comfort noise, seq:%d, level: -%d dBov", packet.SequenceNumber, g.noiseLevel)
+	return nil
+}
+
+// comfortNoise generates white noise at the last CN level, spectral information is not used
+func (g *G711) comfortNoise(packet *rtp.RtpPacket, samples int) []byte {
+	// uniform noise with the CN level as RMS, 0 dBov being full scale
+	amplitude := math.Min(32767*math.Sqrt(3)*math.Pow(10, -float64(g.noiseLevel)/20), 32767)
+	pcm := make([]int16, samples)
+	for i := range pcm {
+		pcm[i] = int16(amplitude * (2*g.noise.Float64() - 1))
+	}
+	g.tones.handleSamples(packet, pcm)
+	return g.samples(g.encode(pcm), pcm)
+}
+
+func (g *G711) silence(samples int) (result []byte) {
+	for i := 0; i < samples; i++ {
+		if g.linear {
+			result = appendSample16(result, 0)
+		} else if g.aLaw {
+			result = append(result, G711_ALAW_SILENCE)
+		} else {
+			result = append(result, G711_ULAW_SILENCE)
+		}
+	}
+	return result
+}
+
+func (g *G711) samples(payload []byte, pcm []int16) []byte {
+	if !g.linear {
+		return payload
+	}
+	result := make([]byte, 0, len(pcm)*2)
+	for _, v := range pcm {
+		result = appendSample16(result, v)
+	}
+	return result
+}
+
+// GetAnalysis reports silence suppression, in-band DTMF digits and test tones
+func (g *G711) GetAnalysis() string {
+	return g.dtx.analysis(G711_SAMPLE_RATE) + g.tones.analysis()
+}
+
+func (g *G711) decode(payload []byte) []int16 {
+	result := make([]int16, len(payload))
+	for i, v := range payload {
+		if g.aLaw {
+			result[i] = alawToLinear(v)
+		} else {
+			result[i] = ulawToLinear(v)
+		}
+	}
+	return result
+}
+
+func (g *G711) encode(pcm []int16) []byte {
+	result := make([]byte, len(pcm))
+	for i, v := range pcm {
+		if g.aLaw {
+			result[i] = linearToAlaw(v)
+		} else {
+			result[i] = linearToUlaw(v)
+		}
+	}
+	return result
+}
+
+// ITU-T G.711 compression of 16 bit linear samples
+func linearToUlaw(sample int16) byte {
+	var sign byte
+	s := int(sample)
+	if s < 0 {
+		s = -s
+		sign = 0x80
+	}
+	if s > 32635 {
+		s = 32635
+	}
+	s += 0x84
+	exponent := 7
+	for mask := 0x4000; s&mask == 0 && exponent > 0; mask >>= 1 {
+		exponent--
+	}
+	mantissa := (s >> uint(exponent+3)) & 0x0F
+	return ^(sign | byte(exponent<<4) | byte(mantissa))
+}
+
+func linearToAlaw(sample int16) byte {
+	sign := byte(0x80)
+	s := int(sample)
+	if s < 0 {
+		s = -s
+		sign = 0x00
+	}
+	s >>= 3
+	if s > 0xFFF {
+		s = 0xFFF
+	}
+	var code byte
+	if s < 32 {
+		code = byte(s >> 1)
+	} else {
+		exponent := 1
+		for v := s >> 5; v > 1; v >>= 1 {
+			exponent++
+		}
+		code = byte(exponent<<4) | byte((s>>uint(exponent))&0x0F)
+	}
+	return (sign | code) ^ 0x55
+}
+
+// ITU-T G.711 expansion to 16 bit linear samples
+func ulawToLinear(u byte) int16 {
+	u = ^u
+	t := (int(u&0x0F) << 3) + 0x84
+	t <<= (uint(u) & 0x70) >> 4
+	if u&0x80 == 0x80 {
+		return int16(0x84 - t)
+	}
+	return int16(t - 0x84)
+}
+
+func alawToLinear(a byte) int16 {
+	a ^= 0x55
+	t := int(a&0x0F) << 4
+	segment := uint(a&0x70) >> 4
+	switch segment {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t += 0x108
+		t <<= segment - 1
+	}
+	if a&0x80 == 0x80 {
+		return int16(t)
+	}
+	return int16(-t)
+}
+
+var PcmuMetadata = CodecMetadata{
+	Name:     "pcmu",
+	LongName: "G.711 u-law (PT 0)",
+	Options: []CodecOption{
+		g711OutputOption,
+		g711TonesOption,
+		g711CnPayloadTypeOption,
+	},
+	Init: NewPcmu,
+}
+
+var PcmaMetadata = CodecMetadata{
+	Name:     "pcma",
+	LongName: "G.711 A-law (PT 8)",
+	Options: []CodecOption{
+		g711OutputOption,
+		g711TonesOption,
+		g711CnPayloadTypeOption,
+	},
+	Init: NewPcma,
+}
+
+var g711OutputOption = CodecOption{
+	Required:         false,
+	Name:             "output",
+	Description:      "WAV sample format, empty for linear PCM",
+	ValidValues:      []string{"pcm", "g711"},
+	ValueDescription: []string{"decoded 16 bit linear PCM", "A-law/u-law WAV format tag"},
+	RestrictValues:   true,
+}
+
+var g711TonesOption = CodecOption{
+	Required:       false,
+	Name:           "tones",
+	Description:    "comma separated test tone frequencies in Hz to detect, such as 1004",
+	RestrictValues: false,
+}
+
+var g711CnPayloadTypeOption = CodecOption{
+	Required:       false,
+	Name:           "cn-payload-type",
+	Description:    "payload type of comfort noise packets, empty for 13",
+	RestrictValues: false,
+}
@@ -0,0 +1,83 @@
+package codecs
+
+import (
+	"errors"
+
+	"github.com/hdiniz/rtpdump/log"
+	"github.com/hdiniz/rtpdump/rtp"
+)
+
+// RFC 3551 - G.722 RTP clock rate is 8000 even though sampling rate is 16000,
+// at 64 kbit/s each octet holds two samples, so one octet per timestamp unit
+const G722_CLOCK_RATE = 8000
+
+// smallest magnitude codewords in both sub-bands
+const G722_SILENCE = 0xFF
+
+// gaps longer than this are treated as a timestamp discontinuity, not loss
+const G722_MAX_GAP = G722_CLOCK_RATE * 60
+
+type G722 struct {
+	started    bool
+	configured bool
+	timestamp  uint32
+}
+
+func NewG722() Codec {
+	return &G722{started: false, configured: false}
+}
+
+func (g *G722) Init() {
+}
+
+func (g G722) GetFormatMagic() []byte {
+	return []byte{}
+}
+
+func (g *G722) invalidState() error {
+	return errors.New("invalid state")
+}
+
+func (g *G722) SetOptions(options map[string]string) error {
+	if g.started {
+		return g.invalidState()
+	}
+	g.configured = true
+	return nil
+}
+
+func (g *G722) HandleRtpPacket(packet *rtp.RtpPacket) (result []byte, err error) {
+	if !g.configured {
+		return nil, g.invalidState()
+	}
+
+	payload := packet.Payload
+	if g.started {
+		gap := int32(packet.Timestamp - g.timestamp)
+		if gap < 0 {
+			if int(-gap) >= len(payload) {
+				return nil, errors.New("g722, samples already written")
+			}
+			payload = payload[-gap:]
+		} else if gap > G722_MAX_GAP {
+			log.Swarn("g722, timestamp jump of %d, not filled", gap)
+		} else if gap > 0 {
+			log.Sdebug("g722, lost octets: %d, time: %d", gap, gap/(G722_CLOCK_RATE/1000))
+			for i := int32(0); i < gap; i++ {
+				result = append(result, G722_SILENCE)
+			}
+		}
+	}
+
+	result = append(result, payload...)
+	g.timestamp = packet.Timestamp + uint32(len(packet.Payload))
+	g.started = true
+	return result, nil
+}
+
+var G722Metadata = CodecMetadata{
+	Name:     "g722",
+	LongName: "G.722 (PT 9)",
+	Options:  []CodecOption{},
+	Init:     NewG722,
+}
@@ -0,0 +1,157 @@
+package codecs
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/hdiniz/rtpdump/log"
+	"github.com/hdiniz/rtpdump/rtp"
+)
+
+const G729_SAMPLE_RATE = 8000
+
+// RFC 3551 - 10 ms frames of 10 octets, Annex B SID frame of 2 octets ends the packet
+const G729_FRAME_SAMPLES = 80
+const G729_FRAME_SIZE = 10
+const G729_SID_SIZE = 2
+
+// ITU-T G.729 reference bitstream, a 16 bit word per bit
+const G729_SYNC_WORD = 0x6B21
+const G729_BIT_0 = 0x007F
+const G729_BIT_1 = 0x0081
+const G729_SPEECH_BITS = 80
+const G729_SID_BITS = 15
+
+// gaps longer than this are treated as a timestamp discontinuity, not DTX or loss
+const G729_MAX_GAP_SAMPLES = G729_SAMPLE_RATE * 60
+
+type G729 struct {
+	started    bool
+	configured bool
+	timestamp  uint32
+	dtx        dtxTracker
+}
+
+func NewG729() Codec {
+	return &G729{started: false, configured: false}
+}
+
+func (g *G729) Init() {
+}
+
+// GetFormatMagic is empty, the reference bitstream has no file header
+func (g G729) GetFormatMagic() []byte {
+	return []byte{}
+}
+
+func (g *G729) invalidState() error {
+	return errors.New("invalid state")
+}
+
+func (g *G729) SetOptions(options map[string]string) error {
+	if g.started {
+		return g.invalidState()
+	}
+	g.configured = true
+	return nil
+}
+
+func (g *G729) HandleRtpPacket(packet *rtp.RtpPacket) (result []byte, err error) {
+	if !g.configured {
+		return nil, g.invalidState()
+	}
+
+	payload := packet.Payload
+	sid := len(payload)%G729_FRAME_SIZE == G729_SID_SIZE
+	if len(payload) == 0 || !sid && len(payload)%G729_FRAME_SIZE != 0 {
+		return nil, errors.New("g729 payload size is not a multiple of frame size")
+	}
+
+	var frames []byte
+	for i := 0; i+G729_FRAME_SIZE <= len(payload); i += G729_FRAME_SIZE {
+		frames = append(frames, g729Frame(payload[i:], G729_SPEECH_BITS)...)
+	}
+	if sid {
+		frames = append(frames, g729Frame(payload[len(payload)-G729_SID_SIZE:], G729_SID_BITS)...)
+	}
+	count := len(payload)/G729_FRAME_SIZE + len(payload)%G729_FRAME_SIZE/G729_SID_SIZE
+	skip := 0
+
+	if g.started {
+		gap := int32(packet.Timestamp - g.timestamp)
+		if gap < 0 {
+			skip = int(-gap) / G729_FRAME_SAMPLES
+			if skip >= count {
+				return nil, errors.New("g729, samples already written")
+			}
+			frames = frames[skip*(4+2*G729_SPEECH_BITS):]
+		} else if gap > G729_MAX_GAP_SAMPLES {
+			log.Swarn("g729, timestamp jump of %d samples, not filled", gap)
+		} else if gap > 0 {
+			result = g.handleMissingFrames(int(gap)/G729_FRAME_SAMPLES, packet.Marker)
+		}
+	}
+
+	result = append(result, frames...)
+	if speech := len(payload)/G729_FRAME_SIZE - skip; speech > 0 {
+		g.dtx.speech(speech * G729_FRAME_SAMPLES)
+	}
+	if sid {
+		// comfort noise goes on after a SID frame until speech resumes
+		g.dtx.sid(G729_FRAME_SAMPLES)
+	}
+	g.timestamp = packet.Timestamp + uint32(count*G729_FRAME_SAMPLES)
+	g.started = true
+	return result, nil
+}
+
+// handleMissingFrames writes untransmitted frames during DTX, erased frames otherwise
+func (g *G729) handleMissingFrames(count int, talkspurt bool) (result []byte) {
+	dtx := g.dtx.gap(count*G729_FRAME_SAMPLES, talkspurt)
+	if !dtx {
+		log.Sdebug("g729, lost frames: %d, time: %d", count, count*10)
+	}
+	for i := 0; i < count; i++ {
+		if dtx {
+			result = append(result, g729Frame(nil, 0)...)
+		} else {
+			result = append(result, g729ErasedFrame()...)
+		}
+	}
+	return result
+}
+
+// GetAnalysis reports talkspurts and silence suppression
+func (g *G729) GetAnalysis() string {
+	return g.dtx.analysis(G729_SAMPLE_RATE)
+}
+
+// g729Frame serializes the first bits of data, MSB first
+func g729Frame(data []byte, bits int) []byte {
+	result := make([]byte, 4+2*bits)
+	binary.LittleEndian.PutUint16(result, G729_SYNC_WORD)
+	binary.LittleEndian.PutUint16(result[2:], uint16(bits))
+	for i := 0; i < bits; i++ {
+		word := uint16(G729_BIT_0)
+		if data[i/8]&(0x80>>uint(i%8)) != 0 {
+			word = G729_BIT_1
+		}
+		binary.LittleEndian.PutUint16(result[4+2*i:], word)
+	}
+	return result
+}
+
+// g729ErasedFrame is a speech frame with all bit words zero
+func g729ErasedFrame() []byte {
+	result := make([]byte, 4+2*G729_SPEECH_BITS)
+	binary.LittleEndian.PutUint16(result, G729_SYNC_WORD)
+	binary.LittleEndian.PutUint16(result[2:], G729_SPEECH_BITS)
+	return result
+}
+
+var G729Metadata = CodecMetadata{
+	Name:     "g729",
+	LongName: "G.729/G.729B (PT 18)",
+	Options:  []CodecOption{},
+	Init:     NewG729,
+}
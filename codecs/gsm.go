@@ -0,0 +1,105 @@
+package codecs
+
+import (
+	"errors"
+
+	"github.com/hdiniz/rtpdump/log"
+	"github.com/hdiniz/rtpdump/rtp"
+)
+
+const GSM_SAMPLE_RATE = 8000
+
+// RFC 3551 - GSM 06.10 frames of 33 octets, 20 ms each, starting with signature 0xD
+const GSM_FRAME_SIZE = 33
+const GSM_FRAME_SAMPLES = 160
+const GSM_SIGNATURE = 0xD0
+
+// frame decoding to silence, as used by common .gsm writers
+var GSM_SILENCE_FRAME = []byte{
+	0xD8, 0x20, 0xA2, 0xE1, 0x5A,
+	0x50, 0x00, 0x49, 0x24, 0x92, 0x49, 0x24,
+	0x50, 0x00, 0x49, 0x24, 0x92, 0x49, 0x24,
+	0x50, 0x00, 0x49, 0x24, 0x92, 0x49, 0x24,
+	0x50, 0x00, 0x49, 0x24, 0x92, 0x49, 0x24,
+}
+
+// gaps longer than this are treated as a timestamp discontinuity, not loss
+const GSM_MAX_GAP_SAMPLES = GSM_SAMPLE_RATE * 60
+
+type Gsm struct {
+	started    bool
+	configured bool
+	timestamp  uint32
+}
+
+func NewGsm() Codec {
+	return &Gsm{started: false, configured: false}
+}
+
+func (g *Gsm) Init() {
+}
+
+// GetFormatMagic is empty, .gsm files hold frames only
+func (g Gsm) GetFormatMagic() []byte {
+	return []byte{}
+}
+
+func (g *Gsm) invalidState() error {
+	return errors.New("invalid state")
+}
+
+func (g *Gsm) SetOptions(options map[string]string) error {
+	if g.started {
+		return g.invalidState()
+	}
+	g.configured = true
+	return nil
+}
+
+func (g *Gsm) HandleRtpPacket(packet *rtp.RtpPacket) (result []byte, err error) {
+	if !g.configured {
+		return nil, g.invalidState()
+	}
+
+	payload := packet.Payload
+	if len(payload) == 0 || len(payload)%GSM_FRAME_SIZE != 0 {
+		return nil, errors.New("gsm payload size is not a multiple of frame size")
+	}
+	frames := len(payload) / GSM_FRAME_SIZE
+	for i := 0; i < frames; i++ {
+		if payload[i*GSM_FRAME_SIZE]&0xF0 != GSM_SIGNATURE {
+			log.Swarn("gsm, frame without signature, seq: %d", packet.SequenceNumber)
+		}
+	}
+
+	if g.started {
+		gap := int32(packet.Timestamp - g.timestamp)
+		if gap < 0 {
+			skip := int(-gap) / GSM_FRAME_SAMPLES
+			if skip >= frames {
+				return nil, errors.New("gsm, samples already written")
+			}
+			payload = payload[skip*GSM_FRAME_SIZE:]
+		} else if gap > GSM_MAX_GAP_SAMPLES {
+			log.Swarn("gsm, timestamp jump of %d samples, not filled", gap)
+		} else if gap > 0 {
+			count := int(gap) / GSM_FRAME_SAMPLES
+			log.Sdebug("gsm, lost frames: %d, time: %d", count, count*20)
+			for i := 0; i < count; i++ {
+				result = append(result, GSM_SILENCE_FRAME...)
+			}
+		}
+	}
+
+	result = append(result, payload...)
+	g.timestamp = packet.Timestamp + uint32(frames*GSM_FRAME_SAMPLES)
+	g.started = true
+	return result, nil
+}
+
+var GsmMetadata = CodecMetadata{
+	Name:     "gsm",
+	LongName: "GSM 06.10 full rate (PT 3)",
+	Options:  []CodecOption{},
+	Init:     NewGsm,
+}
@@ -0,0 +1,217 @@
+package codecs
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hdiniz/rtpdump/log"
+	"github.com/hdiniz/rtpdump/rtp"
+)
+
+// RFC 2190 - H.263 payload header, mode selected by F and P
+// mode A := [F(1)][P(1)][SBIT(3)][EBIT(3)][SRC(3)][I][U][S][A][R(4)][DBQ(2)][TRB(3)][TR(8)]
+// mode B and C carry GOB and macroblock information in 8 and 12 octets
+const H263_MODE_A_HEADER_SIZE = 4
+const H263_MODE_B_HEADER_SIZE = 8
+const H263_MODE_C_HEADER_SIZE = 12
+
+// H263 rebuilds the bitstream split at arbitrary bit positions, the first and last
+// octets of a packet are shared with the neighbouring packets as given by SBIT and EBIT
+type H263 struct {
+	started bool
+	lastSeq uint16
+
+	// last octet of the previous packet, holding its valid bits
+	partial     byte
+	partialBits int
+
+	modePackets  [3]int
+	intraPackets int
+	lostPackets  int
+}
+
+func NewH263() Codec {
+	return &H263{}
+}
+
+func (c *H263) Init() {
+}
+
+func (c *H263) SetOptions(options map[string]string) error {
+	return nil
+}
+
+// GetFormatMagic is empty, .263 files hold the bitstream only
+func (c H263) GetFormatMagic() []byte {
+	return []byte{}
+}
+
+func (c *H263) GetAnalysis() string {
+	return fmt.Sprintf("Mode A packets: %d\nMode B packets: %d\nMode C packets: %d\nIntra coded packets: %d\nLost packets: %d\n",
+		c.modePackets[0], c.modePackets[1], c.modePackets[2], c.intraPackets, c.lostPackets)
+}
+
+func (c *H263) HandleRtpPacket(packet *rtp.RtpPacket) (result []byte, err error) {
+	payload := packet.Payload
+	if len(payload) < 1 {
+		return nil, errors.New("h263, empty payload")
+	}
+
+	// a shared octet is only completed by the following packet
+	if c.started && packet.SequenceNumber != c.lastSeq+1 {
+		c.lostPackets += int(packet.SequenceNumber - c.lastSeq - 1)
+		log.Sdebug("h263, lost packets before seq:%d", packet.SequenceNumber)
+		result = c.flushPartial()
+	}
+	c.lastSeq = packet.SequenceNumber
+	c.started = true
+
+	mode := 0
+	headerSize := H263_MODE_A_HEADER_SIZE
+	switch payload[0] & 0xC0 {
+	case 0x80:
+		mode, headerSize = 1, H263_MODE_B_HEADER_SIZE
+	case 0xC0:
+		mode, headerSize = 2, H263_MODE_C_HEADER_SIZE
+	}
+	if len(payload) <= headerSize {
+		return result, errors.New("h263, payload too short for header")
+	}
+	c.modePackets[mode]++
+
+	sbit := int(payload[0] >> 3 & 0x07)
+	ebit := int(payload[0] & 0x07)
+	// picture coding type, I bit, 0 for intra coding
+	intra := mode == 0 && payload[1]&0x10 == 0 || mode != 0 && payload[4]&0x80 == 0
+	if intra {
+		c.intraPackets++
+	}
+	log.Sdebug("h263, seq:%d, mode:%c, sbit:%d, ebit:%d, intra:%t",
+		packet.SequenceNumber, 'A'+mode, sbit, ebit, intra)
+
+	data := payload[headerSize:]
+	if sbit > 0 {
+		// EBIT of the previous packet and SBIT add up to the shared octet
+		if c.partialBits == sbit {
+			result = append(result, c.partial|data[0]&(0xFF>>uint(sbit)))
+			c.partialBits = 0
+		} else {
+			// the start of the shared octet was lost with the previous packet, or does not fit it
+			if c.partialBits > 0 {
+				log.Swarn("h263, seq:%d, start bits do not complete the previous packet", packet.SequenceNumber)
+			}
+			result = append(result, c.flushPartial()...)
+		}
+		data = data[1:]
+	} else {
+		result = append(result, c.flushPartial()...)
+	}
+
+	if ebit > 0 && len(data) > 0 {
+		c.partial = data[len(data)-1] & (0xFF << uint(ebit))
+		c.partialBits = 8 - ebit
+		data = data[:len(data)-1]
+	}
+	return append(result, data...), nil
+}
+
+// flushPartial writes the shared octet as is, its last bits are padding
+func (c *H263) flushPartial() []byte {
+	if c.partialBits == 0 {
+		return nil
+	}
+	c.partialBits = 0
+	return []byte{c.partial}
+}
+
+// Flush writes the last octet left waiting for the next packet
+func (c *H263) Flush() []byte {
+	return c.flushPartial()
+}
+
+// RFC 4629 - H.263-1998 and H.263-2000 payload header
+// [RR(5)][P(1)][V(1)][PLEN(6)][PEBIT(3)], followed by VRC(8) when V is set and PLEN octets of extra picture header
+// P set means the packet starts with a picture, GOB or slice start code, its first two zero octets are left out
+type H263Plus struct {
+	pictures int
+	threads  map[int]int
+}
+
+func NewH263Plus() Codec {
+	return &H263Plus{threads: map[int]int{}}
+}
+
+func (c *H263Plus) Init() {
+}
+
+func (c *H263Plus) SetOptions(options map[string]string) error {
+	return nil
+}
+
+// GetFormatMagic is empty, .263 files hold the bitstream only
+func (c H263Plus) GetFormatMagic() []byte {
+	return []byte{}
+}
+
+func (c *H263Plus) GetAnalysis() string {
+	result := fmt.Sprintf("Pictures: %d\n", c.pictures)
+	if len(c.threads) > 0 {
+		result += fmt.Sprintf("Video redundancy coding threads: %d\n", len(c.threads))
+	}
+	return result
+}
+
+func (c *H263Plus) HandleRtpPacket(packet *rtp.RtpPacket) (result []byte, err error) {
+	payload := packet.Payload
+	if len(payload) < 2 {
+		return nil, errors.New("h263-1998, payload too short for header")
+	}
+
+	start := payload[0]&0x04 == 0x04
+	vrc := payload[0]&0x02 == 0x02
+	plen := int(payload[0]&0x01)<<5 | int(payload[1]>>3)
+	offset := 2
+
+	if vrc {
+		// VRC := [TID(3)][Trun(4)][S(1)]
+		if len(payload) < offset+1 {
+			return nil, errors.New("h263-1998, payload too short for VRC")
+		}
+		thread := int(payload[offset] >> 5)
+		c.threads[thread]++
+		log.Sdebug("h263-1998, seq:%d, vrc thread:%d, trun:%d, sync:%t",
+			packet.SequenceNumber, thread, payload[offset]>>1&0x0F, payload[offset]&0x01 == 0x01)
+		offset++
+	}
+
+	// extra picture header is a redundant copy, the bitstream carries its own
+	offset += plen
+	if len(payload) < offset {
+		return nil, errors.New("h263-1998, payload too short for extra picture header")
+	}
+
+	data := payload[offset:]
+	if start {
+		// picture start code := 0000 0000 0000 0000 1000 00
+		if len(data) > 0 && data[0]&0xFC == 0x80 {
+			c.pictures++
+		}
+		result = append(result, 0x00, 0x00)
+	}
+	log.Sdebug("h263-1998, seq:%d, p:%t, plen:%d", packet.SequenceNumber, start, plen)
+	return append(result, data...), nil
+}
+
+var H263Metadata = CodecMetadata{
+	Name:     "h263",
+	LongName: "H.263 (RFC 2190)",
+	Options:  []CodecOption{},
+	Init:     NewH263,
+}
+
+var H263PlusMetadata = CodecMetadata{
+	Name:     "h263-1998",
+	LongName: "H.263-1998/2000 (RFC 4629)",
+	Options:  []CodecOption{},
+	Init:     NewH263Plus,
+}
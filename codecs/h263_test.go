@@ -0,0 +1,65 @@
+package codecs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hdiniz/rtpdump/rtp"
+)
+
+// h263ModeA builds a mode A packet carrying data, SBIT and EBIT bits of the
+// shared octets are set to garbage so that they must be masked out
+func h263ModeA(seq uint16, sbit int, ebit int, data []byte) *rtp.RtpPacket {
+	data = append([]byte{}, data...)
+	if sbit > 0 {
+		data[0] |= 0xFF << uint(8-sbit)
+	}
+	if ebit > 0 {
+		data[len(data)-1] |= 0xFF >> uint(8-ebit)
+	}
+	header := []byte{byte(sbit<<3 | ebit), 0x00, 0x00, 0x00}
+	return &rtp.RtpPacket{SequenceNumber: seq, Payload: append(header, data...)}
+}
+
+func TestH263SharedOctet(t *testing.T) {
+	tests := []struct {
+		name     string
+		sbit     int
+		ebit     int
+		seq2     uint16
+		expected []byte
+	}{
+		{"ebit 3 sbit 5", 5, 3, 2, []byte{0xAA, 0xBC, 0xDE}},
+		{"ebit 4 sbit 4", 4, 4, 2, []byte{0xAA, 0xBC, 0xDE}},
+		{"ebit 6 sbit 2", 2, 6, 2, []byte{0xAA, 0xBC, 0xDE}},
+		{"ebit 1 sbit 7", 7, 1, 2, []byte{0xAA, 0xBC, 0xDE}},
+		// mismatch, the previous octet is written with its padding bits cleared and the next one dropped
+		{"mismatch", 4, 3, 2, []byte{0xAA, 0xB8, 0xDE}},
+		// lost packet, the octet is written as it was left and the orphan start bits dropped
+		{"lost", 5, 3, 3, []byte{0xAA, 0xB8, 0xDE}},
+	}
+
+	for _, test := range tests {
+		c := NewH263()
+		// the shared octet 0xBC is split with 8-EBIT bits in the first packet and 8-SBIT in the second
+		first := []byte{0xAA, 0xBC &^ (0xFF >> uint(8-test.ebit))}
+		second := []byte{0xBC &^ (0xFF << uint(8-test.sbit)), 0xDE}
+
+		var result []byte
+		for _, p := range []*rtp.RtpPacket{
+			h263ModeA(1, 0, test.ebit, first),
+			h263ModeA(test.seq2, test.sbit, 0, second),
+		} {
+			frames, err := c.HandleRtpPacket(p)
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+			result = append(result, frames...)
+		}
+		result = append(result, c.(Flusher).Flush()...)
+
+		if !bytes.Equal(result, test.expected) {
+			t.Errorf("%s: got % X, expected % X", test.name, result, test.expected)
+		}
+	}
+}
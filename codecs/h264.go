@@ -1,6 +1,10 @@
 package codecs
 import (
+  "encoding/base64"
   "errors"
+  "fmt"
+  "strconv"
+  "strings"
   "github.com/hdiniz/rtpdump/log"
   "github.com/hdiniz/rtpdump/rtp"
 )
@@ -11,10 +15,34 @@ var NON_INTERLEAVED_MODE = 1
 var INTERLEAVED_MODE = 2
 
 type H264 struct {
-  packetizationMode string
+  packetizationMode int
   started bool
   configured bool
   timestamp uint32
+  lastSeq uint16
+
+  cvo cvoTracker
+  analyzer h264Analyzer
+
+  // fragmented NAL unit reassembly and loss handling
+  flagIncomplete bool
+  waitIdr bool
+  waitingIdr bool
+  incompleteNalUnits int
+  skippedSlices int
+
+  // out-of-band sprop-parameter-sets, written until the stream carries its own
+  parameterSets [][]byte
+  parameterSetsWritten bool
+  inBandParameterSets bool
+
+  // interleaved mode de-interleaving buffer
+  interleavingDepth int
+  deintBufReq int
+  pending []h264NalUnit
+  fragmenting bool
+  fragmentDon uint16
+  fragment []byte
 }
 
 func NewH264() Codec {
@@ -31,15 +59,124 @@ func (c *H264) SetOptions(options map[string]string) error {
     return errors.New("required codec option not present")
   }
 
-  c.packetizationMode = v
+  mode, err := strconv.Atoi(v)
+  if err != nil || mode < SINGLE_NAL_MODE || mode > INTERLEAVED_MODE {
+    return errors.New("invalid codec option value")
+  }
+  c.packetizationMode = mode
+
+  c.flagIncomplete = options["incomplete-nal"] == "flag"
+  c.waitIdr = options["wait-idr"] == "1"
+
+  fmtp := ParseFmtp(options["fmtp"])
+  if v, ok = fmtp["sprop-interleaving-depth"]; ok {
+    if c.interleavingDepth, err = strconv.Atoi(v); err != nil || c.interleavingDepth < 0 {
+      return errors.New("invalid sprop-interleaving-depth")
+    }
+  }
+  if v, ok = fmtp["sprop-deint-buf-req"]; ok {
+    if c.deintBufReq, err = strconv.Atoi(v); err != nil || c.deintBufReq < 0 {
+      return errors.New("invalid sprop-deint-buf-req")
+    }
+  }
+
+  v, ok = options["sprop-parameter-sets"]
+  if !ok {
+    v = fmtp["sprop-parameter-sets"]
+  }
+  if c.parameterSets, err = parseParameterSets(v); err != nil {
+    return err
+  }
+  // written at the start as format magic
+  c.parameterSetsWritten = true
+
+  v,ok = options["cvo-id"]
+  if ok && v != "" {
+    id, err := strconv.Atoi(v)
+    if err != nil || id < 0 || id > 255 {
+      return errors.New("invalid codec option value")
+    }
+    c.cvo.extensionId = id
+  }
   return nil
 }
 
+// GetFormatMagic returns the sprop-parameter-sets, so the dump can be decoded from its start
 func (c H264) GetFormatMagic() []byte {
-  return []byte{}
+  return c.getParameterSets()
+}
+
+func (c *H264) getParameterSets() (result []byte) {
+  for _, v := range c.parameterSets {
+    result = append(result, []byte{0x00, 0x00, 0x00, 0x01}...)
+    result = append(result, v...)
+  }
+  return result
+}
+
+// parseParameterSets decodes comma separated base64 NAL units, such as "Z0IACpZTBYmI,aMljiA=="
+func parseParameterSets(sprop string) (result [][]byte, err error) {
+  for _, v := range strings.Split(sprop, ",") {
+    v = strings.TrimSpace(v)
+    if v == "" {
+      continue
+    }
+    nalUnit, err := base64.StdEncoding.DecodeString(v)
+    if err != nil {
+      // padding is sometimes left out
+      nalUnit, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(v, "="))
+    }
+    if err != nil || len(nalUnit) == 0 {
+      return nil, errors.New("invalid sprop-parameter-sets")
+    }
+    log.Sdebug("h264, sprop-parameter-sets nalType:%d, size:%d", nalUnit[0] & 0x1F, len(nalUnit))
+    result = append(result, nalUnit)
+  }
+  return result, nil
+}
+
+func (c *H264) GetMetadata() map[string][]byte {
+  return map[string][]byte{
+    CVO_METADATA_EXTENSION: c.cvo.metadata(),
+    H264_FRAMES_METADATA_EXTENSION: c.analyzer.metadata(),
+  }
+}
+
+func (c *H264) GetAnalysis() string {
+  return c.analyzer.analysis() +
+    fmt.Sprintf("Incomplete NAL units: %d\nSlices skipped waiting for IDR: %d\n",
+    c.incompleteNalUnits, c.skippedSlices) + c.cvo.analysis()
 }
 
 func (c *H264) HandleRtpPacket(packet *rtp.RtpPacket) (result []byte, err error) {
+  c.cvo.handleRtpPacket(packet)
+
+  if len(packet.Payload) < 1 {
+    return nil, errors.New("h264, empty payload")
+  }
+
+  // fragments of a NAL unit are sent in consecutive packets
+  lost := c.started && packet.SequenceNumber != c.lastSeq + 1
+  if lost {
+    log.Sdebug("h264, lost packets before seq:%d", packet.SequenceNumber)
+    result = c.dropFragment("lost packets")
+    c.handleLoss()
+  } else if c.fragmenting && packet.Payload[0] & 0x1F != 28 {
+    result = c.dropFragment("fragment interrupted")
+  }
+  c.lastSeq = packet.SequenceNumber
+  c.started = true
+
+  // access units are grouped after a fragment cut by loss is handled, it belongs to the previous one
+  c.analyzer.handleRtpPacket(packet, lost)
+  nalUnits, err := c.handlePayload(packet)
+  if err != nil {
+    c.analyzer.incomplete()
+  }
+  return append(result, nalUnits...), err
+}
+
+func (c *H264) handlePayload(packet *rtp.RtpPacket) (result []byte, err error) {
   payload := packet.Payload
   forbidden := (payload[0] & 0x80) == 0x80
   if forbidden {
@@ -53,15 +190,27 @@ func (c *H264) HandleRtpPacket(packet *rtp.RtpPacket) (result []byte, err error)
   log.Sdebug("h264, seq:%d nri:%d, nalType:%d",
     packet.SequenceNumber, nri, nalType)
 
+  // single NAL unit and non-interleaved packets are accepted in both non-interleaved modes
   switch {
-    case nalType >= 1 && nalType <= 23:
+    case nalType >= 1 && nalType <= 23 && !c.isInterleaved():
       return c.handleNalUnit(payload[:])
-    case nalType >= 24 && nalType <= 27:
-      //aggregation packet
-      log.Debug("h264, aggregation not supported")
-      return nil, errors.New("h264, aggregation not supported")
+    case nalType == 24 && !c.isInterleaved():
+      return c.handleStapA(payload[:])
+    case nalType == 25 && c.isInterleaved():
+      return c.handleStapB(payload[:])
+    case nalType == 26 && c.isInterleaved():
+      return c.handleMtap(payload[:], 2)
+    case nalType == 27 && c.isInterleaved():
+      return c.handleMtap(payload[:], 3)
+    case nalType == 28 && c.isInterleaved():
+      return c.handleInterleavedFuA(payload[:])
     case nalType == 28:
       return c.handleFuA(payload[:])
+    case nalType == 29 && c.isInterleaved():
+      return c.handleFuB(payload[:])
+    case nalType >= 1 && nalType <= 29:
+      log.Sdebug("h264, nal type %d not allowed in packetization mode %d", nalType, c.packetizationMode)
+      return nil, errors.New("h264, nal type not allowed in packetization mode")
     default:
       log.Sdebug("h264, nal type not supported")
       return nil, errors.New("h264, nal type not supported")
@@ -69,27 +218,120 @@ func (c *H264) HandleRtpPacket(packet *rtp.RtpPacket) (result []byte, err error)
 }
 
 func (c *H264) handleNalUnit(payload []byte) (result []byte, err error) {
+  // interleaved NAL units are analyzed as received, before de-interleaving
+  if !c.isInterleaved() {
+    c.analyzer.handleNalUnit(payload)
+  }
+
+  nalType := payload[0] & 0x1F
+  if c.waitingIdr && nalType == 5 {
+    log.Sdebug("h264, IDR found, slices no longer skipped")
+    c.waitingIdr = false
+  } else if c.waitingIdr && nalType >= 1 && nalType <= 4 {
+    // parameter sets and other non-VCL NAL units still go through
+    c.skippedSlices++
+    return nil, nil
+  }
+
+  // parameter sets are written again before an IDR picture following non-IDR slices
+  switch {
+    case nalType == 7 || nalType == 8:
+      c.inBandParameterSets = true
+    case nalType == 5 && !c.parameterSetsWritten && !c.inBandParameterSets:
+      result = c.getParameterSets()
+      c.parameterSetsWritten = true
+    case nalType >= 1 && nalType <= 4:
+      c.parameterSetsWritten = false
+  }
+
   result = append(result, []byte{0x00, 0x00, 0x00, 0x01}...)
   result = append(result, payload[:]...)
   return result, nil
 }
+func (c *H264) handleStapA(payload []byte) (result []byte, err error) {
+  // STAP-A := [STAP-A NAL HDR][NALU 1 size(16bit)][NALU 1 HDR][NALU 1 data]..[NALU n size(16bit)][NALU n HDR][NALU n data]
+  for offset := 1; offset < len(payload); {
+    if offset + 2 > len(payload) {
+      return nil, errors.New("h264, STAP-A too short for NAL unit size")
+    }
+    size := int(payload[offset]) << 8 | int(payload[offset + 1])
+    offset += 2
+    if size == 0 || offset + size > len(payload) {
+      return nil, errors.New("h264, STAP-A NAL unit size exceeds payload")
+    }
+
+    log.Sdebug("h264, STAP-A nalType:%d, size:%d", payload[offset] & 0x1F, size)
+    nalUnit, _ := c.handleNalUnit(payload[offset:offset + size])
+    result = append(result, nalUnit...)
+    offset += size
+  }
+  return result, nil
+}
+
 func (c *H264) handleFuA(payload []byte) (result []byte, err error) {
+  // FU-A := [FU indicator][FU header][FU payload], FU header := [S][E][R][Type(5bit)]
+  if len(payload) < 2 {
+    return nil, errors.New("h264, FU-A too short for FU header")
+  }
   isStart := payload[1] & 0x80 == 0x80
-  //isEnd := payload[0] & 0x40 == 0x40
 
   log.Sdebug("h264, FU-A isStart:%t", isStart)
   if isStart {
-    result = append(result, []byte{0x00, 0x00, 0x00, 0x01}...)
-    nalUnitHeader := payload[0] & 0xE0
-    nalUnitHeader = nalUnitHeader | (payload[1] & 0x1F)
-    result = append(result, nalUnitHeader)
-    result = append(result, payload[2:]...)
-  } else {
-    result = append(result, payload[2:]...)
+    result = c.dropFragment("start of next NAL unit before end")
+    c.fragmenting = true
+    c.fragment = []byte{payload[0] & 0xE0 | payload[1] & 0x1F}
+  } else if !c.fragmenting {
+    // start fragment was lost, or the NAL unit was already dropped
+    return nil, errors.New("h264, FU-A fragment without start")
+  }
+
+  return append(result, c.appendFragment(payload[1], payload[2:])...), nil
+}
+
+// appendFragment adds FU payload to the NAL unit, which is handled once the end bit is set
+func (c *H264) appendFragment(fuHeader byte, data []byte) []byte {
+  c.fragment = append(c.fragment, data...)
+  if fuHeader & 0x40 != 0x40 {
+    return nil
+  }
+  return c.completeFragment()
+}
+
+func (c *H264) completeFragment() (result []byte) {
+  c.fragmenting = false
+  if c.isInterleaved() {
+    return c.deinterleave(h264NalUnit{c.fragmentDon, c.fragment})
   }
-  log.Sdebug("FU-A: %#v", result)
+  result, _ = c.handleNalUnit(c.fragment)
+  return result
+}
+
+// dropFragment handles a fragmented NAL unit missing fragments, it is
+// written with the forbidden bit set when incomplete NAL units are flagged
+func (c *H264) dropFragment(reason string) []byte {
+  if !c.fragmenting {
+    return nil
+  }
+  c.fragmenting = false
+  c.incompleteNalUnits++
+  c.analyzer.incomplete()
+  log.Swarn("h264, incomplete fragmented NAL unit, %s", reason)
+  c.handleLoss()
+
+  if !c.flagIncomplete {
+    // received fragments still count in the access unit
+    c.analyzer.handleNalUnit(c.fragment)
+    return nil
+  }
+  c.fragment[0] = c.fragment[0] | 0x80
+  return c.completeFragment()
+}
 
-  return
+func (c *H264) handleLoss() {
+  if c.waitIdr && !c.waitingIdr {
+    log.Sdebug("h264, skipping slices until next IDR")
+    c.waitingIdr = true
+  }
 }
 
 
@@ -98,6 +340,11 @@ var H264Metadata = CodecMetadata{
   LongName: "H.264",
   Options: []CodecOption {
     h264PacketizationModeOption,
+    h264CvoIdOption,
+    h264IncompleteNalOption,
+    h264WaitIdrOption,
+    h264SpropParameterSetsOption,
+    h264FmtpOption,
   },
   Init: NewH264,
 }
@@ -105,8 +352,47 @@ var H264Metadata = CodecMetadata{
 var h264PacketizationModeOption = CodecOption{
   Required: true,
   Name: "packetization-mode",
-  Description: "whether this payload is octet-aligned or bandwidth-efficient",
+  Description: "RTP packetization mode of the stream",
   ValidValues: []string {"0", "1", "2"},
   ValueDescription: []string {"Single NAL Unit Mode", "Non-Interleaved Mode", "Interleaved Mode"},
   RestrictValues: true,
 }
+
+var h264CvoIdOption = CodecOption{
+  Required: false,
+  Name: "cvo-id",
+  Description: "extmap id of urn:3gpp:video-orientation, empty if not negotiated",
+  RestrictValues: false,
+}
+
+var h264IncompleteNalOption = CodecOption{
+  Required: false,
+  Name: "incomplete-nal",
+  Description: "fragmented NAL units missing fragments, empty to drop",
+  ValidValues: []string {"drop", "flag"},
+  ValueDescription: []string {"not written", "written with the forbidden bit set"},
+  RestrictValues: true,
+}
+
+var h264WaitIdrOption = CodecOption{
+  Required: false,
+  Name: "wait-idr",
+  Description: "after a loss, skip slices until the next IDR",
+  ValidValues: []string {"0", "1"},
+  ValueDescription: []string {"write all slices", "skip slices until the next IDR"},
+  RestrictValues: true,
+}
+
+var h264SpropParameterSetsOption = CodecOption{
+  Required: false,
+  Name: "sprop-parameter-sets",
+  Description: "base64 SPS and PPS written before IDR pictures until the stream carries its own, empty to use fmtp",
+  RestrictValues: false,
+}
+
+var h264FmtpOption = CodecOption{
+  Required: false,
+  Name: "fmtp",
+  Description: "a=fmtp parameters, used for sprop-parameter-sets, sprop-interleaving-depth and sprop-deint-buf-req",
+  RestrictValues: false,
+}
@@ -0,0 +1,415 @@
+package codecs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hdiniz/rtpdump/rtp"
+	"github.com/hdiniz/rtpdump/util"
+)
+
+// ITU-T H.264 parameter sets and slice headers, parsed for stream analysis
+
+const H264_CLOCK_RATE = 90000
+
+const H264_FRAMES_METADATA_EXTENSION = ".frames.csv"
+
+var H264_PROFILE_NAMES = map[uint]string{
+	44: "CAVLC 4:4:4 Intra", 66: "Baseline", 77: "Main", 88: "Extended", 100: "High",
+	110: "High 10", 122: "High 4:2:2", 244: "High 4:4:4 Predictive",
+}
+
+// slice_type % 5
+var H264_SLICE_TYPES = []string{"P", "B", "I", "SP", "SI"}
+
+// h264Reader reads RBSP syntax elements, the first error is kept and
+// following reads return zero
+type h264Reader struct {
+	*bitReader
+	err error
+}
+
+func newH264Reader(nalUnit []byte) *h264Reader {
+	// emulation prevention bytes, 0x000003, are removed from the NAL unit payload
+	var rbsp []byte
+	zeros := 0
+	for _, v := range nalUnit[1:] {
+		if zeros >= 2 && v == 0x03 {
+			zeros = 0
+			continue
+		}
+		if v == 0x00 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, v)
+	}
+	return &h264Reader{bitReader: newBitReader(rbsp)}
+}
+
+func (r *h264Reader) u(n int) uint {
+	if r.err != nil {
+		return 0
+	}
+	v, err := r.readBits(n)
+	r.err = err
+	return v
+}
+
+func (r *h264Reader) flag() bool {
+	return r.u(1) == 1
+}
+
+// ue reads an unsigned exp-Golomb code
+func (r *h264Reader) ue() uint {
+	leadingZeros := 0
+	for r.err == nil && r.u(1) == 0 {
+		leadingZeros++
+		if leadingZeros > 31 {
+			r.err = fmt.Errorf("h264, invalid exp-Golomb code")
+		}
+	}
+	if r.err != nil {
+		return 0
+	}
+	return 1<<uint(leadingZeros) - 1 + r.u(leadingZeros)
+}
+
+// se reads a signed exp-Golomb code
+func (r *h264Reader) se() int {
+	v := int(r.ue())
+	if v%2 == 0 {
+		return -v / 2
+	}
+	return (v + 1) / 2
+}
+
+type h264Sps struct {
+	profile         uint
+	constraints     uint
+	level           uint
+	width           uint
+	height          uint
+	frameMbsOnly    bool
+	frameRate       float64
+	log2MaxFrameNum uint
+}
+
+func (s h264Sps) profileName() string {
+	name, ok := H264_PROFILE_NAMES[s.profile]
+	if !ok {
+		return fmt.Sprintf("profile %d", s.profile)
+	}
+	if s.profile == 66 && s.constraints&0x40 == 0x40 {
+		return "Constrained Baseline"
+	}
+	return name
+}
+
+func parseSps(nalUnit []byte) (*h264Sps, error) {
+	r := newH264Reader(nalUnit)
+	sps := &h264Sps{}
+	sps.profile = r.u(8)
+	sps.constraints = r.u(8)
+	sps.level = r.u(8)
+	r.ue() // seq_parameter_set_id
+
+	chromaFormat := uint(1)
+	separateColourPlane := false
+	switch sps.profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = r.ue()
+		if chromaFormat == 3 {
+			separateColourPlane = r.flag()
+		}
+		r.ue()   // bit_depth_luma_minus8
+		r.ue()   // bit_depth_chroma_minus8
+		r.flag() // qpprime_y_zero_transform_bypass_flag
+		if r.flag() {
+			// seq_scaling_matrix_present_flag
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.flag() {
+					size := 64
+					if i < 6 {
+						size = 16
+					}
+					skipScalingList(r, size)
+				}
+			}
+		}
+	}
+
+	sps.log2MaxFrameNum = r.ue() + 4
+	switch r.ue() {
+	// pic_order_cnt_type
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.flag() // delta_pic_order_always_zero_flag
+		r.se()   // offset_for_non_ref_pic
+		r.se()   // offset_for_top_to_bottom_field
+		for i := r.ue(); i > 0 && r.err == nil; i-- {
+			r.se() // offset_for_ref_frame
+		}
+	}
+	r.ue()   // max_num_ref_frames
+	r.flag() // gaps_in_frame_num_value_allowed_flag
+	widthMbs := r.ue() + 1
+	heightMapUnits := r.ue() + 1
+	sps.frameMbsOnly = r.flag()
+	if !sps.frameMbsOnly {
+		r.flag() // mb_adaptive_frame_field_flag
+	}
+	r.flag() // direct_8x8_inference_flag
+
+	fieldFactor := uint(2)
+	if sps.frameMbsOnly {
+		fieldFactor = 1
+	}
+	sps.width = widthMbs * 16
+	sps.height = heightMapUnits * 16 * fieldFactor
+	if r.flag() {
+		// frame_cropping_flag, offsets in chroma sample units
+		cropX, cropY := uint(1), fieldFactor
+		if chromaFormat != 0 && !separateColourPlane {
+			if chromaFormat != 3 {
+				cropX = 2
+			}
+			if chromaFormat == 1 {
+				cropY = 2 * fieldFactor
+			}
+		}
+		left, right, top, bottom := r.ue(), r.ue(), r.ue(), r.ue()
+		sps.width -= cropX * (left + right)
+		sps.height -= cropY * (top + bottom)
+	}
+
+	if r.flag() {
+		parseVui(r, sps)
+	}
+	return sps, r.err
+}
+
+func skipScalingList(r *h264Reader, size int) {
+	last, next := 8, 8
+	for i := 0; i < size && r.err == nil; i++ {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+// parseVui reads video usability information up to timing info
+func parseVui(r *h264Reader, sps *h264Sps) {
+	if r.flag() {
+		// aspect_ratio_info_present_flag, 255 is Extended_SAR
+		if r.u(8) == 255 {
+			r.u(16)
+			r.u(16)
+		}
+	}
+	if r.flag() {
+		r.flag() // overscan_appropriate_flag
+	}
+	if r.flag() {
+		// video_signal_type_present_flag
+		r.u(3)
+		r.flag()
+		if r.flag() {
+			r.u(24) // colour_primaries, transfer_characteristics, matrix_coefficients
+		}
+	}
+	if r.flag() {
+		r.ue() // chroma_sample_loc_type_top_field
+		r.ue() // chroma_sample_loc_type_bottom_field
+	}
+	if r.flag() {
+		// timing_info_present_flag, a frame is two ticks
+		numUnitsInTick := r.u(32)
+		timeScale := r.u(32)
+		if r.err == nil && numUnitsInTick > 0 {
+			sps.frameRate = float64(timeScale) / float64(2*numUnitsInTick)
+		}
+	}
+}
+
+type h264Pps struct {
+	cabac bool
+}
+
+func parsePps(nalUnit []byte) (*h264Pps, error) {
+	r := newH264Reader(nalUnit)
+	r.ue() // pic_parameter_set_id
+	r.ue() // seq_parameter_set_id
+	pps := &h264Pps{cabac: r.flag()}
+	return pps, r.err
+}
+
+// parseSliceType reads first_mb_in_slice and slice_type of a slice header
+func parseSliceType(nalUnit []byte) (firstMb uint, sliceType string, err error) {
+	r := newH264Reader(nalUnit)
+	firstMb = r.ue()
+	v := r.ue()
+	if r.err != nil {
+		return 0, "", r.err
+	}
+	return firstMb, H264_SLICE_TYPES[v%5], nil
+}
+
+// h264Frame is an access unit, NAL units sharing the same RTP timestamp
+type h264Frame struct {
+	receivedAt time.Time
+	timestamp  uint32
+	frameType  string
+	size       int
+	packets    int
+	complete   bool
+	marker     bool
+}
+
+func (f h264Frame) csv() string {
+	return fmt.Sprintf("%s,%d,%s,%d,%d,%t\n",
+		util.TimeMsToStr(f.receivedAt), f.timestamp, f.frameType, f.size, f.packets, f.complete && f.marker)
+}
+
+type h264Analyzer struct {
+	sps     *h264Sps
+	pps     *h264Pps
+	frames  []h264Frame
+	current *h264Frame
+}
+
+// handleRtpPacket starts a new access unit when the timestamp changes or the previous one ended with the marker bit,
+// an access unit following lost packets may be missing its start
+func (a *h264Analyzer) handleRtpPacket(packet *rtp.RtpPacket, lost bool) {
+	if a.current == nil || a.current.marker || a.current.timestamp != packet.Timestamp {
+		a.frames = append(a.frames, h264Frame{
+			receivedAt: packet.ReceivedAt,
+			timestamp:  packet.Timestamp,
+			complete:   true,
+		})
+		a.current = &a.frames[len(a.frames)-1]
+	}
+	if lost {
+		a.current.complete = false
+	}
+	a.current.packets++
+	a.current.marker = packet.Marker
+}
+
+func (a *h264Analyzer) handleNalUnit(nalUnit []byte) {
+	if a.current == nil {
+		return
+	}
+	a.current.size += len(nalUnit)
+	if nalUnit[0]&0x80 == 0x80 {
+		// forbidden bit, flagged incomplete NAL unit
+		a.current.complete = false
+	}
+
+	switch nalType := nalUnit[0] & 0x1F; {
+	case nalType == 7:
+		if sps, err := parseSps(nalUnit); err == nil {
+			a.sps = sps
+		}
+	case nalType == 8:
+		if pps, err := parsePps(nalUnit); err == nil {
+			a.pps = pps
+		}
+	case nalType >= 1 && nalType <= 5:
+		_, sliceType, err := parseSliceType(nalUnit)
+		if err != nil {
+			return
+		}
+		if nalType == 5 {
+			sliceType = "IDR"
+		}
+		// I slices take precedence over P and B slices in the frame type
+		if a.current.frameType == "" || a.current.frameType != "IDR" && sliceType == "I" || sliceType == "IDR" {
+			a.current.frameType = sliceType
+		}
+	}
+}
+
+// incomplete flags the access unit being received, a NAL unit was dropped
+func (a *h264Analyzer) incomplete() {
+	if a.current != nil {
+		a.current.complete = false
+	}
+}
+
+func (a *h264Analyzer) metadata() []byte {
+	if len(a.frames) == 0 {
+		return nil
+	}
+	result := []byte("time,timestamp,type,size,packets,complete\n")
+	for _, v := range a.frames {
+		result = append(result, []byte(v.csv())...)
+	}
+	return result
+}
+
+func (a *h264Analyzer) analysis() string {
+	result := ""
+	if a.sps != nil {
+		result += fmt.Sprintf("Profile: %s, level %.1f\nResolution: %dx%d",
+			a.sps.profileName(), float64(a.sps.level)/10, a.sps.width, a.sps.height)
+		if !a.sps.frameMbsOnly {
+			result += " interlaced"
+		}
+		result += "\n"
+		if a.sps.frameRate > 0 {
+			result += fmt.Sprintf("Frame rate (VUI): %.2f fps\n", a.sps.frameRate)
+		}
+	} else {
+		result += "SPS: not found\n"
+	}
+	if a.pps != nil {
+		entropy := "CAVLC"
+		if a.pps.cabac {
+			entropy = "CABAC"
+		}
+		result += fmt.Sprintf("Entropy coding: %s\n", entropy)
+	}
+
+	incomplete, totalSize, maxSize := 0, 0, 0
+	var idrFrames []int
+	for i, v := range a.frames {
+		if !v.complete || !v.marker {
+			incomplete++
+		}
+		if v.frameType == "IDR" {
+			idrFrames = append(idrFrames, i)
+		}
+		totalSize += v.size
+		if v.size > maxSize {
+			maxSize = v.size
+		}
+	}
+	result += fmt.Sprintf("Frames: %d\nIncomplete frames: %d\nIDR frames: %d\n", len(a.frames), incomplete, len(idrFrames))
+	if len(a.frames) == 0 {
+		return result
+	}
+
+	// timestamps are 90 kHz, uint32 subtraction handles wrap around
+	ms := func(first, last int) float64 {
+		return float64(a.frames[last].timestamp-a.frames[first].timestamp) * 1000 / H264_CLOCK_RATE
+	}
+	if duration := ms(0, len(a.frames)-1); duration > 0 {
+		result += fmt.Sprintf("Frame rate (measured): %.2f fps\n", float64(len(a.frames)-1)*1000/duration)
+	}
+	if n := len(idrFrames); n > 1 {
+		first, last := idrFrames[0], idrFrames[n-1]
+		result += fmt.Sprintf("IDR interval: %d frames, %.0f ms\n", (last-first)/(n-1), ms(first, last)/float64(n-1))
+	}
+	result += fmt.Sprintf("Frame size: average %d bytes, maximum %d bytes\n", totalSize/len(a.frames), maxSize)
+	return result
+}
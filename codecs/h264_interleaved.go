@@ -0,0 +1,160 @@
+package codecs
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/hdiniz/rtpdump/log"
+)
+
+// RFC 6184 interleaved mode, NAL units carry a decoding order number (DON)
+// and are reordered in a de-interleaving buffer before being written
+
+type h264NalUnit struct {
+	don  uint16
+	data []byte
+}
+
+func (u h264NalUnit) isVcl() bool {
+	nalType := u.data[0] & 0x1F
+	return nalType >= 1 && nalType <= 5
+}
+
+func (c *H264) isInterleaved() bool {
+	return c.packetizationMode == INTERLEAVED_MODE
+}
+
+func (c *H264) handleStapB(payload []byte) (result []byte, err error) {
+	// STAP-B := [STAP-B NAL HDR][DON(16bit)][NALU 1 size(16bit)][NALU 1]..[NALU n size(16bit)][NALU n]
+	// NAL units follow in consecutive decoding order
+	if len(payload) < 3 {
+		return nil, errors.New("h264, STAP-B too short for DON")
+	}
+	don := binary.BigEndian.Uint16(payload[1:])
+
+	var units []h264NalUnit
+	for offset := 3; offset < len(payload); don++ {
+		if offset+2 > len(payload) {
+			return nil, errors.New("h264, STAP-B too short for NAL unit size")
+		}
+		size := int(binary.BigEndian.Uint16(payload[offset:]))
+		offset += 2
+		if size == 0 || offset+size > len(payload) {
+			return nil, errors.New("h264, STAP-B NAL unit size exceeds payload")
+		}
+		log.Sdebug("h264, STAP-B don:%d, nalType:%d, size:%d", don, payload[offset]&0x1F, size)
+		units = append(units, h264NalUnit{don, payload[offset : offset+size]})
+		offset += size
+	}
+	return c.deinterleave(units...), nil
+}
+
+func (c *H264) handleMtap(payload []byte, tsOffsetSize int) (result []byte, err error) {
+	// MTAP := [MTAP NAL HDR][DONB(16bit)][NALU 1 size(16bit)][DOND(8bit)][TS offset(16/24bit)][NALU 1]..
+	// NAL unit size includes DOND and TS offset, DON is DONB + DOND
+	if len(payload) < 3 {
+		return nil, errors.New("h264, MTAP too short for DONB")
+	}
+	donb := binary.BigEndian.Uint16(payload[1:])
+
+	var units []h264NalUnit
+	for offset := 3; offset < len(payload); {
+		if offset+2 > len(payload) {
+			return nil, errors.New("h264, MTAP too short for NAL unit size")
+		}
+		size := int(binary.BigEndian.Uint16(payload[offset:]))
+		offset += 2
+		if size <= 1+tsOffsetSize || offset+size > len(payload) {
+			return nil, errors.New("h264, MTAP NAL unit size exceeds payload")
+		}
+		don := donb + uint16(payload[offset])
+		nalUnit := payload[offset+1+tsOffsetSize : offset+size]
+		log.Sdebug("h264, MTAP don:%d, nalType:%d, size:%d", don, nalUnit[0]&0x1F, len(nalUnit))
+		units = append(units, h264NalUnit{don, nalUnit})
+		offset += size
+	}
+	return c.deinterleave(units...), nil
+}
+
+func (c *H264) handleFuB(payload []byte) (result []byte, err error) {
+	// FU-B := [FU indicator][FU header][DON(16bit)][FU payload], first fragment only
+	if len(payload) < 4 {
+		return nil, errors.New("h264, FU-B too short for DON")
+	}
+	if payload[1]&0x80 != 0x80 {
+		return nil, errors.New("h264, FU-B without start bit")
+	}
+	result = c.dropFragment("start of next NAL unit before end")
+
+	c.fragmenting = true
+	c.fragmentDon = binary.BigEndian.Uint16(payload[2:])
+	c.fragment = []byte{payload[0]&0xE0 | payload[1]&0x1F}
+	return append(result, c.appendFragment(payload[1], payload[4:])...), nil
+}
+
+// handleInterleavedFuA appends the following fragments of a NAL unit started by FU-B
+func (c *H264) handleInterleavedFuA(payload []byte) (result []byte, err error) {
+	if len(payload) < 2 {
+		return nil, errors.New("h264, FU-A too short for FU header")
+	}
+	if payload[1]&0x80 == 0x80 {
+		return nil, errors.New("h264, FU-A start fragment in interleaved mode, FU-B expected")
+	}
+	if !c.fragmenting {
+		return nil, errors.New("h264, FU-A fragment without FU-B start")
+	}
+	return c.appendFragment(payload[1], payload[2:]), nil
+}
+
+// deinterleave buffers NAL units until more VCL NAL units than
+// sprop-interleaving-depth, or more than sprop-deint-buf-req bytes, are waiting
+func (c *H264) deinterleave(units ...h264NalUnit) (result []byte) {
+	for _, unit := range units {
+		c.analyzer.handleNalUnit(unit.data)
+	}
+	c.pending = append(c.pending, units...)
+	for c.pendingVclUnits() > c.interleavingDepth || c.deintBufReq > 0 && c.pendingSize() > c.deintBufReq {
+		result = append(result, c.writeNextPending()...)
+	}
+	return result
+}
+
+// Flush handles a fragmented NAL unit cut by the end of the stream,
+// then writes NAL units still waiting in the de-interleaving buffer
+func (c *H264) Flush() (result []byte) {
+	result = c.dropFragment("stream ended")
+	for len(c.pending) > 0 {
+		result = append(result, c.writeNextPending()...)
+	}
+	return result
+}
+
+// writeNextPending writes the NAL unit first in decoding order, DON wraps around
+func (c *H264) writeNextPending() []byte {
+	next := 0
+	for i, unit := range c.pending {
+		if int16(unit.don-c.pending[next].don) < 0 {
+			next = i
+		}
+	}
+	unit := c.pending[next]
+	c.pending = append(c.pending[:next], c.pending[next+1:]...)
+	result, _ := c.handleNalUnit(unit.data)
+	return result
+}
+
+func (c *H264) pendingVclUnits() (count int) {
+	for _, unit := range c.pending {
+		if unit.isVcl() {
+			count++
+		}
+	}
+	return count
+}
+
+func (c *H264) pendingSize() (size int) {
+	for _, unit := range c.pending {
+		size += len(unit.data)
+	}
+	return size
+}
@@ -0,0 +1,270 @@
+package codecs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hdiniz/rtpdump/log"
+	"github.com/hdiniz/rtpdump/rtp"
+)
+
+// RFC 7798 - RTP payload format for HEVC
+// NAL unit header := [F(1)][Type(6)][LayerId(6)][TID(3)]
+
+const H265_AP = 48
+const H265_FU = 49
+const H265_PACI = 50
+
+func h265NalType(header byte) byte {
+	return header >> 1 & 0x3F
+}
+
+// h265NalUnit is a NAL unit with its 2 octet header, DON is 0 without DONL
+type h265NalUnit struct {
+	don  uint16
+	data []byte
+}
+
+type H265 struct {
+	started bool
+	lastSeq uint16
+
+	parameterSets [][]byte
+
+	// DONL is present when sprop-max-don-diff or sprop-depack-buf-nalus are above 0,
+	// NAL units are then written in decoding order
+	donl           bool
+	depackBufNalus int
+	pending        []h265NalUnit
+
+	fragmenting        bool
+	fragmentDon        uint16
+	fragment           []byte
+	nalUnits           int
+	incompleteNalUnits int
+}
+
+func NewH265() Codec {
+	return &H265{}
+}
+
+func (c *H265) Init() {
+}
+
+func (c *H265) SetOptions(options map[string]string) (err error) {
+	fmtp := ParseFmtp(options["fmtp"])
+	for _, v := range []string{"sprop-vps", "sprop-sps", "sprop-pps"} {
+		sets, err := parseParameterSets(fmtp[v])
+		if err != nil {
+			return errors.New("invalid " + v)
+		}
+		c.parameterSets = append(c.parameterSets, sets...)
+	}
+
+	maxDonDiff := 0
+	if v, ok := fmtp["sprop-max-don-diff"]; ok {
+		if maxDonDiff, err = strconv.Atoi(v); err != nil || maxDonDiff < 0 {
+			return errors.New("invalid sprop-max-don-diff")
+		}
+	}
+	if v, ok := fmtp["sprop-depack-buf-nalus"]; ok {
+		if c.depackBufNalus, err = strconv.Atoi(v); err != nil || c.depackBufNalus < 0 {
+			return errors.New("invalid sprop-depack-buf-nalus")
+		}
+	}
+	c.donl = maxDonDiff > 0 || c.depackBufNalus > 0
+	return nil
+}
+
+// GetFormatMagic returns sprop-vps, sprop-sps and sprop-pps, so the dump can be decoded from its start
+func (c H265) GetFormatMagic() (result []byte) {
+	for _, v := range c.parameterSets {
+		result = append(result, []byte{0x00, 0x00, 0x00, 0x01}...)
+		result = append(result, v...)
+	}
+	return result
+}
+
+func (c *H265) GetAnalysis() string {
+	return fmt.Sprintf("NAL units: %d\nIncomplete NAL units: %d\n",
+		c.nalUnits, c.incompleteNalUnits)
+}
+
+func (c *H265) HandleRtpPacket(packet *rtp.RtpPacket) ([]byte, error) {
+	payload := packet.Payload
+	if len(payload) < 2 {
+		return nil, errors.New("h265, payload too short for NAL unit header")
+	}
+
+	// fragments of a NAL unit are sent in consecutive packets
+	if c.started && packet.SequenceNumber != c.lastSeq+1 {
+		c.dropFragment("lost packets")
+	} else if c.fragmenting && h265NalType(payload[0]) != H265_FU {
+		c.dropFragment("fragment interrupted")
+	}
+	c.lastSeq = packet.SequenceNumber
+	c.started = true
+
+	if payload[0]&0x80 == 0x80 {
+		return nil, errors.New("h265, forbidden bit set in this payload")
+	}
+
+	nalType := h265NalType(payload[0])
+	log.Sdebug("h265, seq:%d, nalType:%d", packet.SequenceNumber, nalType)
+
+	switch {
+	case nalType == H265_AP:
+		return c.handleAp(payload)
+	case nalType == H265_FU:
+		return c.handleFu(payload)
+	case nalType == H265_PACI:
+		return nil, errors.New("h265, PACI not supported")
+	case nalType > H265_PACI:
+		return nil, errors.New("h265, nal type not supported")
+	default:
+		return c.handleSingleNalUnit(payload)
+	}
+}
+
+func (c *H265) handleSingleNalUnit(payload []byte) ([]byte, error) {
+	// single NAL unit := [NAL HDR][DONL(16bit)][NAL unit payload]
+	if !c.donl {
+		return c.writeNalUnit(h265NalUnit{data: payload}), nil
+	}
+	if len(payload) < 4 {
+		return nil, errors.New("h265, single NAL unit too short for DONL")
+	}
+	nalUnit := append(append([]byte{}, payload[:2]...), payload[4:]...)
+	return c.writeNalUnit(h265NalUnit{binary.BigEndian.Uint16(payload[2:]), nalUnit}), nil
+}
+
+func (c *H265) handleAp(payload []byte) (result []byte, err error) {
+	// AP := [PayloadHdr][DONL(16bit)][NALU 1 size(16bit)][NALU 1]..[DOND(8bit)][NALU n size(16bit)][NALU n]
+	// DON of following NAL units is the previous DON + DOND + 1
+	var don uint16
+	for offset := 2; offset < len(payload); {
+		if c.donl {
+			if offset == 2 {
+				if offset+2 > len(payload) {
+					return result, errors.New("h265, AP too short for DONL")
+				}
+				don = binary.BigEndian.Uint16(payload[offset:])
+				offset += 2
+			} else {
+				don += uint16(payload[offset]) + 1
+				offset++
+			}
+		}
+		if offset+2 > len(payload) {
+			return result, errors.New("h265, AP too short for NAL unit size")
+		}
+		size := int(binary.BigEndian.Uint16(payload[offset:]))
+		offset += 2
+		if size < 2 || offset+size > len(payload) {
+			return result, errors.New("h265, AP NAL unit size exceeds payload")
+		}
+		log.Sdebug("h265, AP don:%d, nalType:%d, size:%d", don, h265NalType(payload[offset]), size)
+		result = append(result, c.writeNalUnit(h265NalUnit{don, payload[offset : offset+size]})...)
+		offset += size
+	}
+	return result, nil
+}
+
+func (c *H265) handleFu(payload []byte) ([]byte, error) {
+	// FU := [PayloadHdr][FU header][DONL(16bit)][FU payload], FU header := [S][E][FuType(6bit)]
+	// DONL is only present in the start fragment
+	if len(payload) < 3 {
+		return nil, errors.New("h265, FU too short for FU header")
+	}
+	fuHeader := payload[2]
+	isStart := fuHeader&0x80 == 0x80
+	data := payload[3:]
+
+	log.Sdebug("h265, FU isStart:%t", isStart)
+	if isStart {
+		c.dropFragment("start of next NAL unit before end")
+		if c.donl {
+			if len(data) < 2 {
+				return nil, errors.New("h265, FU too short for DONL")
+			}
+			c.fragmentDon = binary.BigEndian.Uint16(data)
+			data = data[2:]
+		}
+		c.fragmenting = true
+		c.fragment = []byte{payload[0]&0x81 | (fuHeader&0x3F)<<1, payload[1]}
+	} else if !c.fragmenting {
+		// start fragment was lost, or the NAL unit was already dropped
+		return nil, errors.New("h265, FU fragment without start")
+	}
+
+	c.fragment = append(c.fragment, data...)
+	if fuHeader&0x40 != 0x40 {
+		return nil, nil
+	}
+	c.fragmenting = false
+	return c.writeNalUnit(h265NalUnit{c.fragmentDon, c.fragment}), nil
+}
+
+// dropFragment discards a fragmented NAL unit missing fragments
+func (c *H265) dropFragment(reason string) {
+	if !c.fragmenting {
+		return
+	}
+	c.fragmenting = false
+	c.incompleteNalUnits++
+	log.Swarn("h265, incomplete fragmented NAL unit, %s", reason)
+}
+
+// writeNalUnit writes NAL units in Annex B format, with DONL they wait until
+// more than sprop-depack-buf-nalus are buffered and are written in DON order
+func (c *H265) writeNalUnit(unit h265NalUnit) (result []byte) {
+	c.nalUnits++
+	if !c.donl {
+		return append([]byte{0x00, 0x00, 0x00, 0x01}, unit.data...)
+	}
+	c.pending = append(c.pending, unit)
+	for len(c.pending) > c.depackBufNalus {
+		result = append(result, c.writeNextPending()...)
+	}
+	return result
+}
+
+// Flush writes NAL units still waiting for decoding order
+func (c *H265) Flush() (result []byte) {
+	c.dropFragment("stream ended")
+	for len(c.pending) > 0 {
+		result = append(result, c.writeNextPending()...)
+	}
+	return result
+}
+
+// writeNextPending writes the NAL unit first in decoding order, DON wraps around
+func (c *H265) writeNextPending() []byte {
+	next := 0
+	for i, unit := range c.pending {
+		if int16(unit.don-c.pending[next].don) < 0 {
+			next = i
+		}
+	}
+	unit := c.pending[next]
+	c.pending = append(c.pending[:next], c.pending[next+1:]...)
+	return append([]byte{0x00, 0x00, 0x00, 0x01}, unit.data...)
+}
+
+var H265Metadata = CodecMetadata{
+	Name:     "h265",
+	LongName: "H.265/HEVC",
+	Options: []CodecOption{
+		h265FmtpOption,
+	},
+	Init: NewH265,
+}
+
+var h265FmtpOption = CodecOption{
+	Required:       false,
+	Name:           "fmtp",
+	Description:    "a=fmtp parameters, used for sprop-vps, sprop-sps, sprop-pps, sprop-max-don-diff and sprop-depack-buf-nalus",
+	RestrictValues: false,
+}
@@ -0,0 +1,168 @@
+package codecs
+
+import (
+	"errors"
+
+	"github.com/hdiniz/rtpdump/log"
+	"github.com/hdiniz/rtpdump/rtp"
+)
+
+const ILBC_SAMPLE_RATE = 8000
+
+// RFC 3952 storage format magic, one per frame length
+const ILBC_20_MAGIC = "#!iLBC20\n"
+const ILBC_30_MAGIC = "#!iLBC30\n"
+
+const ILBC_20_FRAME_SIZE = 38
+const ILBC_30_FRAME_SIZE = 50
+
+// gaps longer than this are treated as a timestamp discontinuity, not loss
+const ILBC_MAX_GAP_SAMPLES = ILBC_SAMPLE_RATE * 60
+
+type Ilbc struct {
+	started    bool
+	configured bool
+	autoMode   bool
+	mode       int
+	timestamp  uint32
+}
+
+func NewIlbc() Codec {
+	return &Ilbc{started: false, configured: false, mode: 30}
+}
+
+func (ilbc *Ilbc) Init() {
+}
+
+func (ilbc *Ilbc) frameSize() int {
+	if ilbc.mode == 20 {
+		return ILBC_20_FRAME_SIZE
+	}
+	return ILBC_30_FRAME_SIZE
+}
+
+func (ilbc *Ilbc) frameSamples() int {
+	return ilbc.mode * ILBC_SAMPLE_RATE / 1000
+}
+
+func (ilbc Ilbc) GetFormatMagic() []byte {
+	if ilbc.autoMode {
+		// written along with the first frames once the mode is known
+		return []byte{}
+	}
+	return ilbc.magic()
+}
+
+func (ilbc *Ilbc) magic() []byte {
+	if ilbc.mode == 20 {
+		return []byte(ILBC_20_MAGIC)
+	}
+	return []byte(ILBC_30_MAGIC)
+}
+
+func (ilbc *Ilbc) invalidState() error {
+	return errors.New("invalid state")
+}
+
+func (ilbc *Ilbc) SetOptions(options map[string]string) error {
+	if ilbc.started {
+		return ilbc.invalidState()
+	}
+
+	// mode is detected from the payload size when neither option nor fmtp give it
+	v, ok := options["mode"]
+	if !ok {
+		v, ok = ParseFmtp(options["fmtp"])["mode"]
+	}
+	ilbc.autoMode = !ok
+	if !ok || v == "30" {
+		ilbc.mode = 30
+	} else if v == "20" {
+		ilbc.mode = 20
+	} else {
+		return errors.New("invalid codec option value")
+	}
+
+	ilbc.configured = true
+	return nil
+}
+
+func (ilbc *Ilbc) HandleRtpPacket(packet *rtp.RtpPacket) (result []byte, err error) {
+	if !ilbc.configured {
+		return nil, ilbc.invalidState()
+	}
+
+	payload := packet.Payload
+	if !ilbc.started && ilbc.autoMode {
+		// 30 ms, the default mode, wins when the size fits both
+		if len(payload)%ILBC_30_FRAME_SIZE != 0 && len(payload)%ILBC_20_FRAME_SIZE == 0 {
+			ilbc.mode = 20
+		}
+		log.Sinfo("ilbc auto-detect: %d ms frames", ilbc.mode)
+		result = ilbc.magic()
+	}
+
+	frameSize := ilbc.frameSize()
+	if len(payload) == 0 || len(payload)%frameSize != 0 {
+		return nil, errors.New("ilbc payload size is not a multiple of frame size")
+	}
+	frames := len(payload) / frameSize
+
+	if ilbc.started {
+		gap := int32(packet.Timestamp - ilbc.timestamp)
+		if gap < 0 {
+			skip := int(-gap) / ilbc.frameSamples()
+			if skip >= frames {
+				return nil, errors.New("ilbc, samples already written")
+			}
+			payload = payload[skip*frameSize:]
+		} else if gap > ILBC_MAX_GAP_SAMPLES {
+			log.Swarn("ilbc, timestamp jump of %d samples, not filled", gap)
+		} else if gap > 0 {
+			result = ilbc.handleMissingFrames(int(gap) / ilbc.frameSamples())
+		}
+	}
+
+	result = append(result, payload...)
+	ilbc.timestamp = packet.Timestamp + uint32(frames*ilbc.frameSamples())
+	ilbc.started = true
+	return result, nil
+}
+
+// handleMissingFrames writes frames with the empty frame indicator set,
+// the last bit of a frame, so decoders run packet loss concealment, RFC 3951
+func (ilbc *Ilbc) handleMissingFrames(count int) (result []byte) {
+	log.Sdebug("ilbc, lost frames: %d, time: %d", count, count*ilbc.mode)
+	for i := 0; i < count; i++ {
+		frame := make([]byte, ilbc.frameSize())
+		frame[len(frame)-1] = 0x01
+		result = append(result, frame...)
+	}
+	return result
+}
+
+var IlbcMetadata = CodecMetadata{
+	Name:     "ilbc",
+	LongName: "iLBC",
+	Options: []CodecOption{
+		ilbcModeOption,
+		ilbcFmtpOption,
+	},
+	Init: NewIlbc,
+}
+
+var ilbcModeOption = CodecOption{
+	Required:         false,
+	Name:             "mode",
+	Description:      "frame length, empty to use fmtp or detect from payload size",
+	ValidValues:      []string{"20", "30"},
+	ValueDescription: []string{"20 ms, 38 octets", "30 ms, 50 octets"},
+	RestrictValues:   true,
+}
+
+var ilbcFmtpOption = CodecOption{
+	Required:       false,
+	Name:           "fmtp",
+	Description:    "a=fmtp parameters, used for options left empty",
+	RestrictValues: false,
+}
@@ -0,0 +1,54 @@
+package codecs
+
+import (
+	"encoding/binary"
+)
+
+// IVF container, little endian
+// file header := [DKIF][version(16)][header size(16)][fourcc][width(16)][height(16)][rate(32)][scale(32)][frames(32)][unused(32)]
+// frame header := [frame size(32)][timestamp(64)]
+const IVF_HEADER_SIZE = 32
+const IVF_FRAME_HEADER_SIZE = 12
+
+// frame timestamps are kept in RTP clock units, 90 kHz for video
+const IVF_TIME_BASE = 90000
+
+type ivfWriter struct {
+	fourcc string
+	width  int
+	height int
+	frames int
+
+	started       bool
+	lastTimestamp uint32
+	timestamp     int64
+}
+
+func (w *ivfWriter) header() []byte {
+	header := make([]byte, IVF_HEADER_SIZE)
+	copy(header, "DKIF")
+	binary.LittleEndian.PutUint16(header[6:], IVF_HEADER_SIZE)
+	copy(header[8:], w.fourcc)
+	binary.LittleEndian.PutUint16(header[12:], uint16(w.width))
+	binary.LittleEndian.PutUint16(header[14:], uint16(w.height))
+	binary.LittleEndian.PutUint32(header[16:], IVF_TIME_BASE)
+	binary.LittleEndian.PutUint32(header[20:], 1)
+	binary.LittleEndian.PutUint32(header[24:], uint32(w.frames))
+	return header
+}
+
+// frame returns the frame with its header, the first frame is at time 0
+// and RTP timestamp differences are added from there
+func (w *ivfWriter) frame(timestamp uint32, data []byte) []byte {
+	if w.started {
+		w.timestamp += int64(int32(timestamp - w.lastTimestamp))
+	}
+	w.started = true
+	w.lastTimestamp = timestamp
+	w.frames++
+
+	header := make([]byte, IVF_FRAME_HEADER_SIZE)
+	binary.LittleEndian.PutUint32(header, uint32(len(data)))
+	binary.LittleEndian.PutUint64(header[4:], uint64(w.timestamp))
+	return append(header, data...)
+}
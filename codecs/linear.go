@@ -0,0 +1,157 @@
+package codecs
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/hdiniz/rtpdump/log"
+	"github.com/hdiniz/rtpdump/rtp"
+)
+
+// RFC 3551 static payload types 10 and 11 are 44100 Hz
+const LINEAR_DEFAULT_SAMPLE_RATE = 44100
+
+// gaps longer than this are treated as a timestamp discontinuity, not loss
+const LINEAR_MAX_GAP_SECONDS = 60
+
+type Linear struct {
+	started       bool
+	configured    bool
+	bitsPerSample int
+	sampleRate    int
+	channels      int
+	timestamp     uint32
+
+	dataSize int
+}
+
+func NewL16() Codec {
+	return &Linear{started: false, configured: false, bitsPerSample: 16}
+}
+
+func NewL24() Codec {
+	return &Linear{started: false, configured: false, bitsPerSample: 24}
+}
+
+func (l *Linear) Init() {
+}
+
+func (l *Linear) format() wavFormat {
+	return wavFormat{WAVE_FORMAT_PCM, l.channels, l.sampleRate, l.bitsPerSample}
+}
+
+func (l Linear) GetFormatMagic() []byte {
+	return l.format().header(l.dataSize)
+}
+
+// GetFinalFormatMagic returns the header with the size of all dumped samples
+func (l *Linear) GetFinalFormatMagic() []byte {
+	return l.format().header(l.dataSize)
+}
+
+func (l *Linear) invalidState() error {
+	return errors.New("invalid state")
+}
+
+func (l *Linear) SetOptions(options map[string]string) error {
+	if l.started {
+		return l.invalidState()
+	}
+
+	l.sampleRate = LINEAR_DEFAULT_SAMPLE_RATE
+	if v, ok := options["sample-rate"]; ok {
+		sampleRate, err := strconv.Atoi(v)
+		if err != nil || sampleRate <= 0 {
+			return errors.New("invalid codec option value")
+		}
+		l.sampleRate = sampleRate
+	}
+
+	l.channels = 1
+	if v, ok := options["channels"]; ok {
+		channels, err := strconv.Atoi(v)
+		if err != nil || channels <= 0 {
+			return errors.New("invalid codec option value")
+		}
+		l.channels = channels
+	}
+
+	l.configured = true
+	return nil
+}
+
+// frameSize is the size of one sample for every channel
+func (l *Linear) frameSize() int {
+	return l.channels * l.bitsPerSample / 8
+}
+
+func (l *Linear) HandleRtpPacket(packet *rtp.RtpPacket) (result []byte, err error) {
+	if !l.configured {
+		return nil, l.invalidState()
+	}
+
+	payload := packet.Payload[:len(packet.Payload)-len(packet.Payload)%l.frameSize()]
+	samples := len(payload) / l.frameSize()
+
+	if l.started {
+		gap := int32(packet.Timestamp - l.timestamp)
+		if gap < 0 {
+			if int(-gap) >= samples {
+				return nil, errors.New("linear, samples already written")
+			}
+			payload = payload[int(-gap)*l.frameSize():]
+		} else if gap > int32(l.sampleRate*LINEAR_MAX_GAP_SECONDS) {
+			log.Swarn("linear, timestamp jump of %d samples, not filled", gap)
+		} else if gap > 0 {
+			log.Sdebug("linear, lost samples: %d", gap)
+			result = append(result, make([]byte, int(gap)*l.frameSize())...)
+		}
+	}
+
+	// network byte order to WAV little endian
+	bytesPerSample := l.bitsPerSample / 8
+	for i := 0; i+bytesPerSample <= len(payload); i += bytesPerSample {
+		for k := bytesPerSample - 1; k >= 0; k-- {
+			result = append(result, payload[i+k])
+		}
+	}
+
+	l.timestamp = packet.Timestamp + uint32(samples)
+	l.started = true
+	l.dataSize += len(result)
+	return result, nil
+}
+
+var L16Metadata = CodecMetadata{
+	Name:     "l16",
+	LongName: "Linear PCM 16 bit",
+	Options: []CodecOption{
+		linearSampleRateOption,
+		linearChannelsOption,
+	},
+	Init: NewL16,
+}
+
+var L24Metadata = CodecMetadata{
+	Name:     "l24",
+	LongName: "Linear PCM 24 bit",
+	Options: []CodecOption{
+		linearSampleRateOption,
+		linearChannelsOption,
+	},
+	Init: NewL24,
+}
+
+var linearSampleRateOption = CodecOption{
+	Required:       false,
+	Name:           "sample-rate",
+	Description:    "sample rate in rtpmap, empty for 44100",
+	RestrictValues: false,
+}
+
+var linearChannelsOption = CodecOption{
+	Required:       false,
+	Name:           "channels",
+	Description:    "number of audio channels in rtpmap, empty for 1",
+	RestrictValues: false,
+}
@@ -0,0 +1,140 @@
+package codecs
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/hdiniz/rtpdump/log"
+	"github.com/hdiniz/rtpdump/rtp"
+)
+
+// RFC 2250 - MPEG-2 transport stream, the payload holds whole 188 octet TS packets
+// TS header := [sync(8)][TEI][PUSI][priority][PID(13)][scrambling(2)][adaptation field control(2)][CC(4)]
+// the continuity counter of a PID increments with each packet carrying payload
+
+const MP2T_PACKET_SIZE = 188
+const MP2T_SYNC_BYTE = 0x47
+const MP2T_NULL_PID = 0x1FFF
+
+type mp2tPid struct {
+	packets          int
+	continuityErrors int
+	started          bool
+	lastCc           byte
+}
+
+type Mp2t struct {
+	started bool
+	lastSeq uint16
+
+	pids             map[int]*mp2tPid
+	packets          int
+	lostPackets      int
+	syncErrors       int
+	transportErrors  int
+	continuityErrors int
+	truncatedPayload int
+}
+
+func NewMp2t() Codec {
+	return &Mp2t{pids: make(map[int]*mp2tPid)}
+}
+
+func (c *Mp2t) Init() {
+}
+
+func (c *Mp2t) SetOptions(options map[string]string) error {
+	return nil
+}
+
+// GetFormatMagic is empty, .ts files are TS packets only
+func (c Mp2t) GetFormatMagic() []byte {
+	return []byte{}
+}
+
+func (c *Mp2t) GetAnalysis() string {
+	result := fmt.Sprintf("TS packets: %d\nLost RTP packets: %d\nSync errors: %d\nTransport errors: %d\nContinuity errors: %d\nTruncated payloads: %d\nPIDs:\n",
+		c.packets, c.lostPackets, c.syncErrors, c.transportErrors, c.continuityErrors, c.truncatedPayload)
+	var pids []int
+	for k := range c.pids {
+		pids = append(pids, k)
+	}
+	sort.Ints(pids)
+	for _, v := range pids {
+		result += fmt.Sprintf("\t0x%04X - %d packets - %d continuity errors\n",
+			v, c.pids[v].packets, c.pids[v].continuityErrors)
+	}
+	return result
+}
+
+// HandleRtpPacket returns the TS packets of the payload, those out of sync are left out
+func (c *Mp2t) HandleRtpPacket(packet *rtp.RtpPacket) (result []byte, err error) {
+	if c.started && packet.SequenceNumber != c.lastSeq+1 {
+		c.lostPackets += int(packet.SequenceNumber - c.lastSeq - 1)
+		log.Sdebug("mp2t, lost packets before seq:%d", packet.SequenceNumber)
+	}
+	c.lastSeq = packet.SequenceNumber
+	c.started = true
+
+	payload := packet.Payload
+	if len(payload)%MP2T_PACKET_SIZE != 0 {
+		log.Swarn("mp2t, seq:%d, payload not a whole number of TS packets", packet.SequenceNumber)
+		c.truncatedPayload++
+	}
+	for ; len(payload) >= MP2T_PACKET_SIZE; payload = payload[MP2T_PACKET_SIZE:] {
+		ts := payload[:MP2T_PACKET_SIZE]
+		if ts[0] != MP2T_SYNC_BYTE {
+			log.Swarn("mp2t, seq:%d, TS packet out of sync", packet.SequenceNumber)
+			c.syncErrors++
+			continue
+		}
+		c.packets++
+		if ts[1]&0x80 == 0x80 {
+			c.transportErrors++
+		}
+		c.checkContinuity(ts)
+		result = append(result, ts...)
+	}
+	return result, nil
+}
+
+// checkContinuity expects the counter to increment when the packet carries payload, to stay
+// otherwise. A single duplicate packet and the discontinuity indicator are allowed
+func (c *Mp2t) checkContinuity(ts []byte) {
+	pid := int(ts[1]&0x1F)<<8 | int(ts[2])
+	if pid == MP2T_NULL_PID {
+		return
+	}
+	state, ok := c.pids[pid]
+	if !ok {
+		state = &mp2tPid{}
+		c.pids[pid] = state
+	}
+	state.packets++
+
+	adaptation := ts[3]&0x20 == 0x20
+	hasPayload := ts[3]&0x10 == 0x10
+	cc := ts[3] & 0x0F
+	discontinuity := adaptation && ts[4] > 0 && ts[5]&0x80 == 0x80
+
+	if state.started && !discontinuity {
+		expected := state.lastCc
+		if hasPayload {
+			expected = (state.lastCc + 1) & 0x0F
+		}
+		if cc != expected && !(hasPayload && cc == state.lastCc) {
+			log.Swarn("mp2t, pid:0x%04X, continuity counter %d, expected %d", pid, cc, expected)
+			state.continuityErrors++
+			c.continuityErrors++
+		}
+	}
+	state.started = true
+	state.lastCc = cc
+}
+
+var Mp2tMetadata = CodecMetadata{
+	Name:     "mp2t",
+	LongName: "MPEG-2 transport stream",
+	Options:  []CodecOption{},
+	Init:     NewMp2t,
+}
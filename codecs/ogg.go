@@ -0,0 +1,71 @@
+package codecs
+
+import (
+	"encoding/binary"
+)
+
+const OGG_HEADER_CONTINUED = 0x01
+const OGG_HEADER_BOS = 0x02
+const OGG_HEADER_EOS = 0x04
+
+// a page header counts its lacing values in a single byte
+const OGG_MAX_SEGMENTS = 255
+
+var oggCrcTable [256]uint32
+
+func init() {
+	// CRC-32 polynomial 0x04c11db7, not reflected, zero initial value
+	for i := range oggCrcTable {
+		r := uint32(i) << 24
+		for k := 0; k < 8; k++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04C11DB7
+			} else {
+				r = r << 1
+			}
+		}
+		oggCrcTable[i] = r
+	}
+}
+
+func oggCrc(data []byte) uint32 {
+	var crc uint32
+	for _, v := range data {
+		crc = crc<<8 ^ oggCrcTable[byte(crc>>24)^v]
+	}
+	return crc
+}
+
+// oggStream builds pages of a single logical bitstream, RFC 3533
+type oggStream struct {
+	serial   uint32
+	sequence uint32
+}
+
+// page holds complete packets only, up to OGG_MAX_SEGMENTS lacing values in total
+func (s *oggStream) page(headerType byte, granule uint64, packets [][]byte) []byte {
+	var lacing []byte
+	var body []byte
+	for _, packet := range packets {
+		size := len(packet)
+		for ; size >= 255; size -= 255 {
+			lacing = append(lacing, 255)
+		}
+		lacing = append(lacing, byte(size))
+		body = append(body, packet...)
+	}
+
+	header := make([]byte, 27)
+	copy(header, "OggS")
+	header[4] = 0
+	header[5] = headerType
+	binary.LittleEndian.PutUint64(header[6:], granule)
+	binary.LittleEndian.PutUint32(header[14:], s.serial)
+	binary.LittleEndian.PutUint32(header[18:], s.sequence)
+	header[26] = byte(len(lacing))
+	s.sequence++
+
+	result := append(append(header, lacing...), body...)
+	binary.LittleEndian.PutUint32(result[22:], oggCrc(result))
+	return result
+}
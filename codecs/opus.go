@@ -0,0 +1,230 @@
+package codecs
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+
+	"github.com/hdiniz/rtpdump/log"
+	"github.com/hdiniz/rtpdump/rtp"
+)
+
+// RFC 7587 - RTP clock rate is always 48000
+const OPUS_SAMPLE_RATE = 48000
+
+const OPUS_OGG_SERIAL = 0x52545044
+
+const OPUS_VENDOR = "rtpdump"
+
+// frame sizes in 48kHz samples, by TOC configuration number, RFC 6716 section 3.1
+var OPUS_FRAME_SAMPLES []int = []int{
+	480, 960, 1920, 2880, 480, 960, 1920, 2880, 480, 960, 1920, 2880, // SILK
+	480, 960, 480, 960, // Hybrid
+	120, 240, 480, 960, 120, 240, 480, 960, 120, 240, 480, 960, 120, 240, 480, 960, // CELT
+}
+
+// RFC 7845 recommended default pre-skip, 80 ms of encoder priming
+const OPUS_DEFAULT_PRE_SKIP = 3840
+
+// gaps longer than this are treated as a timestamp discontinuity, not DTX or loss
+const OPUS_MAX_GAP_SAMPLES = OPUS_SAMPLE_RATE * 60
+
+type Opus struct {
+	started    bool
+	configured bool
+	channels   int
+	preSkip    int
+	timestamp  uint32
+	lastToc    byte
+	// samples of a gap too short for a whole filler frame, filled later
+	pending int
+
+	ogg     oggStream
+	granule uint64
+	page    [][]byte
+}
+
+func NewOpus() Codec {
+	return &Opus{started: false, configured: false, channels: 1, preSkip: OPUS_DEFAULT_PRE_SKIP,
+		ogg: oggStream{serial: OPUS_OGG_SERIAL}}
+}
+
+func (o *Opus) Init() {
+}
+
+// GetFormatMagic returns the OpusHead and OpusTags header pages, RFC 7845
+func (o *Opus) GetFormatMagic() []byte {
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1
+	head[9] = byte(o.channels)
+	// encoder priming is unknown from RTP, output gain 0, channel mapping family 0
+	binary.LittleEndian.PutUint16(head[10:], uint16(o.preSkip))
+	binary.LittleEndian.PutUint32(head[12:], OPUS_SAMPLE_RATE)
+
+	// vendor string and empty user comment list
+	tags := make([]byte, 8+4+len(OPUS_VENDOR)+4)
+	copy(tags, "OpusTags")
+	binary.LittleEndian.PutUint32(tags[8:], uint32(len(OPUS_VENDOR)))
+	copy(tags[12:], OPUS_VENDOR)
+
+	result := o.ogg.page(OGG_HEADER_BOS, 0, [][]byte{head})
+	return append(result, o.ogg.page(0, 0, [][]byte{tags})...)
+}
+
+func (o *Opus) invalidState() error {
+	return errors.New("invalid state")
+}
+
+func (o *Opus) SetOptions(options map[string]string) error {
+	if o.started {
+		return o.invalidState()
+	}
+
+	fmtp := ParseFmtp(options["fmtp"])
+
+	v, ok := options["stereo"]
+	if !ok {
+		// sprop-stereo is the sender hint, stereo the receiver preference
+		v, ok = fmtp["sprop-stereo"]
+		if !ok {
+			v = fmtp["stereo"]
+		}
+	}
+	if v == "1" {
+		o.channels = 2
+	}
+
+	if v, ok := options["pre-skip"]; ok && v != "" {
+		preSkip, err := strconv.Atoi(v)
+		if err != nil || preSkip < 0 || preSkip > 0xFFFF {
+			return errors.New("invalid codec option value")
+		}
+		o.preSkip = preSkip
+	}
+
+	o.configured = true
+	return nil
+}
+
+func (o *Opus) HandleRtpPacket(packet *rtp.RtpPacket) (result []byte, err error) {
+	if !o.configured {
+		return nil, o.invalidState()
+	}
+
+	samples, err := o.getPacketSamples(packet.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.started {
+		gap := int32(packet.Timestamp - o.timestamp)
+		if gap < 0 {
+			return nil, errors.New("opus, samples already written")
+		}
+		// previous page is complete, last page is kept to be flagged end of stream
+		result = o.ogg.page(0, o.granule, o.page)
+		if gap > OPUS_MAX_GAP_SAMPLES {
+			log.Swarn("opus, timestamp jump of %d samples, not filled", gap)
+			o.pending = 0
+		} else if gap > 0 || o.pending > 0 {
+			result = append(result, o.handleMissingSamples(int(gap))...)
+		}
+	}
+
+	o.granule += uint64(samples)
+	o.page = [][]byte{packet.Payload}
+	o.lastToc = packet.Payload[0]
+	o.timestamp = packet.Timestamp + uint32(samples)
+	o.started = true
+	return result, nil
+}
+
+// Flush writes the last page flagged as end of stream
+func (o *Opus) Flush() []byte {
+	if !o.started {
+		return nil
+	}
+	result := o.ogg.page(OGG_HEADER_EOS, o.granule, o.page)
+	o.page = nil
+	return result
+}
+
+// handleMissingSamples covers DTX and lost packets with TOC only packets,
+// a zero length frame is decoded with packet loss concealment. Filler packets
+// are split across pages, samples short of a whole frame are carried forward
+func (o *Opus) handleMissingSamples(gap int) (result []byte) {
+	toc := o.lastToc & 0xFC
+	frameSamples := OPUS_FRAME_SAMPLES[toc>>3]
+	log.Sdebug("opus, missing samples: %d, time: %d", gap, gap/(OPUS_SAMPLE_RATE/1000))
+	gap += o.pending
+	o.pending = gap % frameSamples
+
+	// each TOC only packet takes a single lacing value
+	var packets [][]byte
+	for i := 0; i < gap/frameSamples; i++ {
+		packets = append(packets, []byte{toc})
+		o.granule += uint64(frameSamples)
+		if len(packets) == OGG_MAX_SEGMENTS {
+			result = append(result, o.ogg.page(0, o.granule, packets)...)
+			packets = nil
+		}
+	}
+	if len(packets) > 0 {
+		result = append(result, o.ogg.page(0, o.granule, packets)...)
+	}
+	return result
+}
+
+func (o *Opus) getPacketSamples(payload []byte) (int, error) {
+	if len(payload) < 1 {
+		return 0, errors.New("opus payload too short")
+	}
+	// TOC := [config(5bit)][s][c(2bit)]
+	frameSamples := OPUS_FRAME_SAMPLES[payload[0]>>3]
+	switch payload[0] & 0x03 {
+	case 0:
+		return frameSamples, nil
+	case 1, 2:
+		return 2 * frameSamples, nil
+	default:
+		if len(payload) < 2 {
+			return 0, errors.New("opus payload too short for frame count")
+		}
+		return int(payload[1]&0x3F) * frameSamples, nil
+	}
+}
+
+var OpusMetadata = CodecMetadata{
+	Name:     "opus",
+	LongName: "Opus",
+	Options: []CodecOption{
+		opusStereoOption,
+		opusPreSkipOption,
+		opusFmtpOption,
+	},
+	Init: NewOpus,
+}
+
+var opusStereoOption = CodecOption{
+	Required:         false,
+	Name:             "stereo",
+	Description:      "whether the stream is decoded as stereo",
+	ValidValues:      []string{"0", "1"},
+	ValueDescription: []string{"mono", "stereo"},
+	RestrictValues:   true,
+}
+
+var opusPreSkipOption = CodecOption{
+	Required:       false,
+	Name:           "pre-skip",
+	Description:    "samples at 48 kHz left out at the start of playback, empty for 3840",
+	RestrictValues: false,
+}
+
+var opusFmtpOption = CodecOption{
+	Required:       false,
+	Name:           "fmtp",
+	Description:    "a=fmtp parameters, used for options left empty",
+	RestrictValues: false,
+}
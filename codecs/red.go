@@ -0,0 +1,97 @@
+package codecs
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hdiniz/rtpdump/log"
+	"github.com/hdiniz/rtpdump/rtp"
+)
+
+// RFC 2198 - redundant payload data, blocks are parsed by rtp.ParseRed
+
+// RedDecoder unwraps RFC 2198 packets in front of a codec, redundant blocks
+// stand in for packets missing from the primary encoding
+type RedDecoder struct {
+	payloadType int
+	keepEmpty   bool
+
+	started       bool
+	lastSeq       uint16
+	lastTimestamp uint32
+
+	lost      int
+	recovered int
+}
+
+func NewRedDecoder(payloadType int) *RedDecoder {
+	return &RedDecoder{payloadType: payloadType}
+}
+
+func (d *RedDecoder) GetPayloadType() int {
+	return d.payloadType
+}
+
+// SetKeepEmpty recovers empty redundant blocks too, for codecs implementing EmptyPayloadHandler
+func (d *RedDecoder) SetKeepEmpty(keep bool) {
+	d.keepEmpty = keep
+}
+
+// Unwrap returns the packets to hand to the codec, recovered ones first.
+// Packets of other payload types are returned as they are
+func (d *RedDecoder) Unwrap(packet *rtp.RtpPacket) (packets []*rtp.RtpPacket, err error) {
+	missing := 0
+	if d.started {
+		missing = int(int16(packet.SequenceNumber-d.lastSeq)) - 1
+		if missing < 0 {
+			return nil, errors.New("red, duplicate or reordered packet")
+		}
+		d.lost += missing
+	}
+
+	if packet.PayloadType != d.payloadType {
+		d.update(packet)
+		return []*rtp.RtpPacket{packet}, nil
+	}
+
+	blocks, err := rtp.ParseRed(packet.Payload)
+	if err != nil {
+		d.update(packet)
+		return nil, err
+	}
+
+	// one redundant block per previous packet, the last one is the packet right before
+	redundant := blocks[:len(blocks)-1]
+	for i, v := range redundant {
+		before := len(redundant) - i
+		timestamp := packet.Timestamp - v.TimestampOffset
+		if before > missing || (len(v.Payload) == 0 && !d.keepEmpty) || int32(timestamp-d.lastTimestamp) <= 0 {
+			continue
+		}
+		recovered := *packet
+		recovered.SequenceNumber = packet.SequenceNumber - uint16(before)
+		recovered.Timestamp = timestamp
+		recovered.PayloadType = v.PayloadType
+		recovered.Payload = v.Payload
+		recovered.Marker = false
+		log.Sdebug("red, seq:%d recovered from redundancy", recovered.SequenceNumber)
+		d.recovered++
+		packets = append(packets, &recovered)
+	}
+
+	primary := *packet
+	primary.PayloadType = blocks[len(blocks)-1].PayloadType
+	primary.Payload = blocks[len(blocks)-1].Payload
+	d.update(packet)
+	return append(packets, &primary), nil
+}
+
+func (d *RedDecoder) update(packet *rtp.RtpPacket) {
+	d.started = true
+	d.lastSeq = packet.SequenceNumber
+	d.lastTimestamp = packet.Timestamp
+}
+
+func (d *RedDecoder) GetAnalysis() string {
+	return fmt.Sprintf("RED packets lost: %d\nRED packets recovered from redundancy: %d\n", d.lost, d.recovered)
+}
@@ -0,0 +1,165 @@
+package codecs
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hdiniz/rtpdump/log"
+	"github.com/hdiniz/rtpdump/rtp"
+	"github.com/hdiniz/rtpdump/util"
+)
+
+// RFC 4103 - T.140 real-time text, UTF-8 text blocks, usually sent with RFC 2198 redundancy
+// redundancy is unwrapped by RedDecoder, empty blocks included, so idle packets are not taken as lost
+
+// marks text lost and not recovered from redundancy, ITU-T T.140 missing text marker
+const T140_MISSING_TEXT = '\uFFFD'
+
+const T140_BACKSPACE = '\u0008'
+const T140_BELL = '\u0007'
+const T140_ESC = '\u001B'
+const T140_BOM = '\uFEFF'
+const T140_LINE_SEPARATOR = '\u2028'
+
+type t140Line struct {
+	receivedAt time.Time
+	timestamp  uint32
+	text       []rune
+}
+
+func (l t140Line) String() string {
+	return fmt.Sprintf("%s - %d - %s", util.TimeMsToStr(l.receivedAt), l.timestamp, string(l.text))
+}
+
+type T140 struct {
+	started bool
+	lastSeq uint16
+
+	line   *t140Line
+	lines  []t140Line
+	lastCr bool
+	escape bool
+	csi    bool
+	erased int
+	lost   int
+}
+
+func NewT140() Codec {
+	return &T140{}
+}
+
+func (c *T140) Init() {
+}
+
+func (c *T140) SetOptions(options map[string]string) error {
+	return nil
+}
+
+// HandlesEmptyPayload is true, an empty text block is an idle packet
+func (c *T140) HandlesEmptyPayload() bool {
+	return true
+}
+
+// GetFormatMagic is empty, the transcript is plain text
+func (c T140) GetFormatMagic() []byte {
+	return []byte{}
+}
+
+func (c *T140) GetAnalysis() string {
+	result := fmt.Sprintf("Lines: %d\nCharacters erased: %d\nPackets lost, not recovered from redundancy: %d\nTranscript:\n",
+		len(c.lines), c.erased, c.lost)
+	lines := c.lines
+	if c.line != nil {
+		lines = append(lines, *c.line)
+	}
+	for _, v := range lines {
+		result += fmt.Sprintf("\t%s\n", v)
+	}
+	return result
+}
+
+// HandleRtpPacket returns the transcript lines completed by the packet,
+// text of packets still missing once redundancy was unwrapped is marked lost
+func (c *T140) HandleRtpPacket(packet *rtp.RtpPacket) (result []byte, err error) {
+	if c.started {
+		gap := int(int16(packet.SequenceNumber - c.lastSeq))
+		if gap <= 0 {
+			return nil, errors.New("t140, duplicate or reordered packet")
+		}
+		if gap > 1 {
+			c.lost += gap - 1
+			log.Swarn("t140, text lost before seq:%d", packet.SequenceNumber)
+			result = append(result, c.handleText(packet, string(T140_MISSING_TEXT))...)
+		}
+	}
+	c.lastSeq = packet.SequenceNumber
+	c.started = true
+
+	return append(result, c.handleText(packet, string(packet.Payload))...), nil
+}
+
+// handleText applies T.140 editing, backspace erases the last character of the line,
+// CR LF, LF and LINE SEPARATOR end it. ECMA-48 control sequences are left out
+func (c *T140) handleText(packet *rtp.RtpPacket, text string) (result []byte) {
+	for len(text) > 0 {
+		r, size := utf8.DecodeRuneInString(text)
+		text = text[size:]
+
+		cr := c.lastCr
+		c.lastCr = r == '\r'
+		switch {
+		case c.csi:
+			// parameters until the final byte
+			c.csi = r < 0x40 || r > 0x7E
+		case c.escape:
+			c.escape = false
+			c.csi = r == '['
+		case r == T140_ESC:
+			c.escape = true
+		case r == '\n' && cr:
+			// CR LF ends a single line
+		case r == '\r' || r == '\n' || r == T140_LINE_SEPARATOR:
+			result = append(result, c.endLine(packet)...)
+		case r == T140_BACKSPACE:
+			if c.line != nil && len(c.line.text) > 0 {
+				c.line.text = c.line.text[:len(c.line.text)-1]
+				c.erased++
+			}
+		case r == T140_BOM || r == T140_BELL || r < 0x20:
+			// other control characters do not show in the transcript
+		default:
+			if c.line == nil {
+				c.line = &t140Line{receivedAt: packet.ReceivedAt, timestamp: packet.Timestamp}
+			}
+			c.line.text = append(c.line.text, r)
+		}
+	}
+	return result
+}
+
+func (c *T140) endLine(packet *rtp.RtpPacket) []byte {
+	if c.line == nil {
+		c.line = &t140Line{receivedAt: packet.ReceivedAt, timestamp: packet.Timestamp}
+	}
+	line := *c.line
+	c.line = nil
+	c.lines = append(c.lines, line)
+	return []byte(line.String() + "\n")
+}
+
+// Flush writes the line still being typed when the stream ended
+func (c *T140) Flush() []byte {
+	if c.line == nil {
+		return nil
+	}
+	return c.endLine(nil)
+}
+
+var T140Metadata = CodecMetadata{
+	Name:     "t140",
+	LongName: "T.140 real-time text",
+	Options:  []CodecOption{},
+	Init:     NewT140,
+}
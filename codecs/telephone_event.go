@@ -0,0 +1,161 @@
+package codecs
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hdiniz/rtpdump/log"
+	"github.com/hdiniz/rtpdump/rtp"
+	"github.com/hdiniz/rtpdump/util"
+)
+
+// RFC 4733 - telephone-event payload
+// [event(8)][E(1)][R(1)][volume(6)][duration(16)]
+
+const TELEPHONE_EVENT_METADATA_EXTENSION = ".dtmf"
+
+const TELEPHONE_EVENT_DEFAULT_CLOCK_RATE = 8000
+
+var TELEPHONE_EVENT_NAMES []string = []string{
+	"0", "1", "2", "3", "4", "5", "6", "7", "8", "9", "*", "#", "A", "B", "C", "D", "flash",
+}
+
+// TelephoneEvent is a single event, collapsed from all of its packets
+type TelephoneEvent struct {
+	ReceivedAt time.Time
+	Timestamp  uint32
+	Event      int
+	Volume     int
+	Duration   int
+	Ended      bool
+
+	clockRate int
+	// long events are sent in segments, durations restart from each segment timestamp
+	segmentTimestamp uint32
+	segmentBase      int
+}
+
+func (e TelephoneEvent) Name() string {
+	if e.Event < len(TELEPHONE_EVENT_NAMES) {
+		return TELEPHONE_EVENT_NAMES[e.Event]
+	}
+	return fmt.Sprintf("event %d", e.Event)
+}
+
+// DurationMs converts the duration from timestamp units
+func (e TelephoneEvent) DurationMs() int {
+	return e.Duration * 1000 / e.clockRate
+}
+
+func (e TelephoneEvent) String() string {
+	end := ""
+	if !e.Ended {
+		end = " (no end packet)"
+	}
+	return fmt.Sprintf("%s - %d - %s - %d ms - -%d dBm0%s",
+		util.TimeMsToStr(e.ReceivedAt), e.Timestamp, e.Name(), e.DurationMs(), e.Volume, end)
+}
+
+// TelephoneEvents picks telephone-event packets out of an audio stream
+type TelephoneEvents struct {
+	payloadType int
+	clockRate   int
+	events      []TelephoneEvent
+}
+
+func NewTelephoneEvents(payloadType int, clockRate int) *TelephoneEvents {
+	if clockRate <= 0 {
+		clockRate = TELEPHONE_EVENT_DEFAULT_CLOCK_RATE
+	}
+	return &TelephoneEvents{payloadType: payloadType, clockRate: clockRate}
+}
+
+// HandleRtpPacket returns false for packets of other payload types,
+// which should be handled by the audio codec
+func (t *TelephoneEvents) HandleRtpPacket(packet *rtp.RtpPacket) (bool, error) {
+	if packet.PayloadType != t.payloadType {
+		return false, nil
+	}
+
+	payload := packet.Payload
+	if len(payload) < 4 {
+		return true, errors.New("telephone-event payload too short")
+	}
+
+	event := TelephoneEvent{
+		ReceivedAt: packet.ReceivedAt,
+		Timestamp:  packet.Timestamp,
+		Event:      int(payload[0]),
+		Ended:      payload[1]&0x80 == 0x80,
+		Volume:     int(payload[1] & 0x3F),
+		Duration:   int(payload[2])<<8 | int(payload[3]),
+		clockRate:  t.clockRate,
+	}
+	event.segmentTimestamp = event.Timestamp
+
+	if len(t.events) > 0 {
+		last := &t.events[len(t.events)-1]
+		if last.segmentTimestamp == event.Timestamp && last.Event == event.Event {
+			// update and retransmitted end packets of the same segment, durations are cumulative
+			if duration := last.segmentBase + event.Duration; duration > last.Duration {
+				last.Duration = duration
+			}
+			last.Ended = last.Ended || event.Ended
+			return true, nil
+		}
+		if offset := int(event.Timestamp - last.segmentTimestamp); !last.Ended && last.Event == event.Event &&
+			(offset == last.Duration-last.segmentBase || offset == 0xFFFF) {
+			// long event segment, a new timestamp once duration would overflow. The segment
+			// starts where the previous one ended, at its full duration when its last updates were lost
+			last.segmentBase += offset
+			last.segmentTimestamp = event.Timestamp
+			last.Duration = last.segmentBase + event.Duration
+			last.Ended = event.Ended
+			return true, nil
+		}
+	}
+
+	log.Sdebug("telephone-event, seq:%d, %s", packet.SequenceNumber, event.Name())
+	t.events = append(t.events, event)
+	return true, nil
+}
+
+func (t *TelephoneEvents) GetPayloadType() int {
+	return t.payloadType
+}
+
+func (t *TelephoneEvents) GetClockRate() int {
+	return t.clockRate
+}
+
+func (t *TelephoneEvents) GetEvents() []TelephoneEvent {
+	return t.events
+}
+
+// GetDigits returns event names in order, such as "1234#"
+func (t *TelephoneEvents) GetDigits() string {
+	digits := ""
+	for _, v := range t.events {
+		if v.Event < len(TELEPHONE_EVENT_NAMES)-1 {
+			digits += v.Name()
+		}
+	}
+	return digits
+}
+
+func (t *TelephoneEvents) GetMetadata() map[string][]byte {
+	var result []byte
+	for _, v := range t.events {
+		result = append(result, []byte(v.String()+"\n")...)
+	}
+	return map[string][]byte{TELEPHONE_EVENT_METADATA_EXTENSION: result}
+}
+
+func (t *TelephoneEvents) GetAnalysis() string {
+	result := fmt.Sprintf("Telephone events: %d, digits: %s\n", len(t.events), t.GetDigits())
+	for _, v := range t.events {
+		result += fmt.Sprintf("\t%s\n", v)
+	}
+	return result
+}
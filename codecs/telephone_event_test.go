@@ -0,0 +1,96 @@
+package codecs
+
+import (
+	"testing"
+
+	"github.com/hdiniz/rtpdump/rtp"
+)
+
+type telephoneEventPacket struct {
+	timestamp uint32
+	event     int
+	ended     bool
+	duration  int
+}
+
+func telephoneEventRtp(seq uint16, p telephoneEventPacket) *rtp.RtpPacket {
+	flags := byte(10)
+	if p.ended {
+		flags |= 0x80
+	}
+	return &rtp.RtpPacket{
+		SequenceNumber: seq,
+		Timestamp:      p.timestamp,
+		PayloadType:    101,
+		Payload:        []byte{byte(p.event), flags, byte(p.duration >> 8), byte(p.duration)},
+	}
+}
+
+func TestTelephoneEvents(t *testing.T) {
+	tests := []struct {
+		name      string
+		packets   []telephoneEventPacket
+		durations []int
+		ended     []bool
+	}{
+		{
+			"single event with retransmitted end",
+			[]telephoneEventPacket{
+				{1000, 1, false, 160}, {1000, 1, false, 320}, {1000, 1, true, 800}, {1000, 1, true, 800}, {1000, 1, true, 800},
+			},
+			[]int{800}, []bool{true},
+		},
+		{
+			"two events",
+			[]telephoneEventPacket{
+				{1000, 1, false, 160}, {1000, 1, true, 400}, {3000, 2, false, 160}, {3000, 2, true, 480},
+			},
+			[]int{400, 480}, []bool{true, true},
+		},
+		{
+			"long event in segments",
+			[]telephoneEventPacket{
+				{1000, 5, false, 160}, {1000, 5, false, 65000}, {1000, 5, false, 65535},
+				{1000 + 65535, 5, false, 160}, {1000 + 65535, 5, false, 320},
+				{1000 + 2*65535, 5, false, 160}, {1000 + 2*65535, 5, true, 480}, {1000 + 2*65535, 5, true, 480},
+			},
+			[]int{2*65535 + 480}, []bool{true},
+		},
+		{
+			"long event, last update of a segment lost",
+			[]telephoneEventPacket{
+				{1000, 5, false, 65000},
+				{1000 + 65535, 5, false, 160}, {1000 + 65535, 5, true, 320},
+			},
+			[]int{65535 + 320}, []bool{true},
+		},
+		{
+			"same digit twice, end packets lost",
+			[]telephoneEventPacket{
+				{1000, 1, false, 160}, {1000, 1, false, 400}, {3000, 1, false, 160}, {3000, 1, true, 480},
+			},
+			[]int{400, 480}, []bool{false, true},
+		},
+	}
+
+	for _, test := range tests {
+		events := NewTelephoneEvents(101, 0)
+		for i, p := range test.packets {
+			if _, err := events.HandleRtpPacket(telephoneEventRtp(uint16(i), p)); err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+		}
+
+		result := events.GetEvents()
+		if len(result) != len(test.durations) {
+			t.Errorf("%s: got %d events, expected %d", test.name, len(result), len(test.durations))
+			continue
+		}
+		for i, v := range test.durations {
+			if result[i].Duration != v || result[i].Ended != test.ended[i] {
+				t.Errorf("%s: event %d, got duration %d ended %t, expected %d %t",
+					test.name, i, result[i].Duration, result[i].Ended, v, test.ended[i])
+			}
+		}
+	}
+}
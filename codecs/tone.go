@@ -0,0 +1,229 @@
+package codecs
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/hdiniz/rtpdump/rtp"
+	"github.com/hdiniz/rtpdump/util"
+)
+
+// Goertzel analysis over 205 sample blocks at 8 kHz, about 25 ms each
+const TONE_BLOCK_SAMPLES_8K = 205
+
+// share of the block energy that must be in the detected tones
+const TONE_MIN_ENERGY_RATIO = 0.8
+
+const TONE_MIN_LEVEL = -40.0
+
+// consecutive blocks before a digit or tone is reported, at least 40 ms
+const TONE_MIN_BLOCKS = 2
+
+// column to row tone level difference allowed, ITU-T Q.24
+const DTMF_MAX_TWIST = 4.0
+const DTMF_MAX_REVERSE_TWIST = -8.0
+
+var DTMF_ROW_FREQUENCIES = []float64{697, 770, 852, 941}
+var DTMF_COLUMN_FREQUENCIES = []float64{1209, 1336, 1477, 1633}
+var DTMF_DIGITS = [][]string{
+	{"1", "2", "3", "A"},
+	{"4", "5", "6", "B"},
+	{"7", "8", "9", "C"},
+	{"*", "0", "#", "D"},
+}
+
+type toneSegment struct {
+	name     string
+	start    int
+	samples  int
+	levelSum float64
+	blocks   int
+}
+
+// toneState follows one tone or digit across blocks
+type toneState struct {
+	name   string
+	blocks int
+	index  int
+}
+
+type toneDetector struct {
+	sampleRate int
+	// peak amplitude of a 0 dBm0 sine wave
+	referencePeak float64
+	frequencies   []float64
+
+	started    bool
+	receivedAt time.Time
+	timestamp  uint32
+
+	block    []float64
+	position int
+
+	digit    toneState
+	tones    []toneState
+	dtmf     []toneSegment
+	segments []toneSegment
+}
+
+func newToneDetector(sampleRate int, referencePeak float64, frequencies []float64) toneDetector {
+	return toneDetector{
+		sampleRate:    sampleRate,
+		referencePeak: referencePeak,
+		frequencies:   frequencies,
+		tones:         make([]toneState, len(frequencies)),
+	}
+}
+
+func (t *toneDetector) blockSize() int {
+	return TONE_BLOCK_SAMPLES_8K * t.sampleRate / 8000
+}
+
+// handleSamples analyzes samples following the ones already handled,
+// the first packet gives the time reference
+func (t *toneDetector) handleSamples(packet *rtp.RtpPacket, samples []int16) {
+	if !t.started {
+		t.started = true
+		t.receivedAt = packet.ReceivedAt
+		t.timestamp = packet.Timestamp
+	}
+	for _, v := range samples {
+		t.block = append(t.block, float64(v))
+		if len(t.block) == t.blockSize() {
+			t.handleBlock()
+			t.position += len(t.block)
+			t.block = t.block[:0]
+		}
+	}
+}
+
+// goertzel returns the amplitude of frequency f in the block
+func (t *toneDetector) goertzel(f float64) float64 {
+	coeff := 2 * math.Cos(2*math.Pi*f/float64(t.sampleRate))
+	var s1, s2 float64
+	for _, v := range t.block {
+		s1, s2 = v+coeff*s1-s2, s1
+	}
+	power := s1*s1 + s2*s2 - coeff*s1*s2
+	if power < 0 {
+		power = 0
+	}
+	return 2 * math.Sqrt(power) / float64(len(t.block))
+}
+
+func (t *toneDetector) level(amplitude float64) float64 {
+	if amplitude <= 0 {
+		return math.Inf(-1)
+	}
+	return 20 * math.Log10(amplitude/t.referencePeak)
+}
+
+func (t *toneDetector) handleBlock() {
+	var energy float64
+	for _, v := range t.block {
+		energy += v * v
+	}
+	if energy == 0 {
+		energy = 1
+	}
+	// a sine wave of amplitude A holds N*A^2/2 of the block energy
+	share := func(amplitudes ...float64) float64 {
+		sum := 0.0
+		for _, a := range amplitudes {
+			sum += a * a
+		}
+		return sum * float64(len(t.block)) / 2 / energy
+	}
+
+	row, rowAmplitude := t.strongest(DTMF_ROW_FREQUENCIES)
+	column, columnAmplitude := t.strongest(DTMF_COLUMN_FREQUENCIES)
+	twist := t.level(columnAmplitude) - t.level(rowAmplitude)
+	digit := ""
+	if share(rowAmplitude, columnAmplitude) > TONE_MIN_ENERGY_RATIO &&
+		t.level(rowAmplitude) > TONE_MIN_LEVEL && t.level(columnAmplitude) > TONE_MIN_LEVEL &&
+		twist <= DTMF_MAX_TWIST && twist >= DTMF_MAX_REVERSE_TWIST {
+		digit = DTMF_DIGITS[row][column]
+	}
+	t.dtmf = t.track(&t.digit, digit, (t.level(rowAmplitude)+t.level(columnAmplitude))/2, t.dtmf)
+
+	for i, f := range t.frequencies {
+		amplitude := t.goertzel(f)
+		name := ""
+		if share(amplitude) > TONE_MIN_ENERGY_RATIO && t.level(amplitude) > TONE_MIN_LEVEL {
+			name = fmt.Sprintf("%g Hz", f)
+		}
+		t.segments = t.track(&t.tones[i], name, t.level(amplitude), t.segments)
+	}
+}
+
+func (t *toneDetector) strongest(frequencies []float64) (index int, amplitude float64) {
+	for i, f := range frequencies {
+		if a := t.goertzel(f); a > amplitude {
+			index, amplitude = i, a
+		}
+	}
+	return index, amplitude
+}
+
+// track extends the current segment of state or starts a new one,
+// an empty name ends it
+func (t *toneDetector) track(state *toneState, name string, level float64, segments []toneSegment) []toneSegment {
+	if name == "" || name != state.name {
+		state.name = name
+		state.blocks = 0
+		if name == "" {
+			return segments
+		}
+	}
+	state.blocks++
+	if state.blocks < TONE_MIN_BLOCKS {
+		return segments
+	}
+	if state.blocks == TONE_MIN_BLOCKS {
+		// segment starts with the first block, its level is not counted
+		state.index = len(segments)
+		segments = append(segments, toneSegment{
+			name:    name,
+			start:   t.position - len(t.block)*(TONE_MIN_BLOCKS-1),
+			samples: len(t.block) * (TONE_MIN_BLOCKS - 1),
+		})
+	}
+	segment := &segments[state.index]
+	segment.samples += len(t.block)
+	segment.levelSum += level
+	segment.blocks++
+	return segments
+}
+
+func (t *toneDetector) describe(segment toneSegment, withLevel bool) string {
+	offset := time.Duration(segment.start) * time.Second / time.Duration(t.sampleRate)
+	result := fmt.Sprintf("%s - %d - %s - %d ms",
+		util.TimeMsToStr(t.receivedAt.Add(offset)),
+		t.timestamp+uint32(segment.start),
+		segment.name,
+		segment.samples*1000/t.sampleRate)
+	if withLevel {
+		result += fmt.Sprintf(" - %.1f dBm0", segment.levelSum/float64(segment.blocks))
+	}
+	return result
+}
+
+func (t *toneDetector) analysis() string {
+	digits := ""
+	for _, v := range t.dtmf {
+		digits += v.name
+	}
+	result := fmt.Sprintf("In-band DTMF: %d, digits: %s\n", len(t.dtmf), digits)
+	for _, v := range t.dtmf {
+		result += fmt.Sprintf("\t%s\n", t.describe(v, false))
+	}
+	if len(t.frequencies) == 0 {
+		return result
+	}
+	result += fmt.Sprintf("Test tones: %d\n", len(t.segments))
+	for _, v := range t.segments {
+		result += fmt.Sprintf("\t%s\n", t.describe(v, true))
+	}
+	return result
+}
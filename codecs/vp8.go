@@ -0,0 +1,182 @@
+package codecs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/hdiniz/rtpdump/log"
+	"github.com/hdiniz/rtpdump/rtp"
+)
+
+// RFC 7741 - VP8 payload descriptor
+// [X][R][N][S][R][PID(3)], extended when X := [I][L][T][K][RSV(4)]
+// followed by picture ID (7 or 15 bits), TL0PICIDX(8) and [TID(2)][Y][KEYIDX(5)] when present
+// a frame starts with S set and PID 0, the marker bit is set on its last packet
+
+type Vp8 struct {
+	ivf ivfWriter
+
+	started bool
+	lastSeq uint16
+
+	assembling bool
+	complete   bool
+	timestamp  uint32
+	keyFrame   bool
+	frame      []byte
+
+	pictureId     int
+	lastPictureId int
+	pictureIdBits int
+
+	keyFrames     int
+	droppedFrames int
+	lostFrames    int
+}
+
+func NewVp8() Codec {
+	return &Vp8{ivf: ivfWriter{fourcc: "VP80"}, lastPictureId: -1}
+}
+
+func (c *Vp8) Init() {
+}
+
+func (c *Vp8) SetOptions(options map[string]string) error {
+	return nil
+}
+
+// GetFormatMagic returns the IVF header, frame count and size are only known once done
+func (c Vp8) GetFormatMagic() []byte {
+	return c.ivf.header()
+}
+
+func (c *Vp8) GetFinalFormatMagic() []byte {
+	return c.ivf.header()
+}
+
+func (c *Vp8) GetAnalysis() string {
+	return fmt.Sprintf("Resolution: %dx%d\nFrames: %d\nKey frames: %d\nIncomplete frames dropped: %d\nFrames lost (picture ID): %d\n",
+		c.ivf.width, c.ivf.height, c.ivf.frames, c.keyFrames, c.droppedFrames, c.lostFrames)
+}
+
+func (c *Vp8) HandleRtpPacket(packet *rtp.RtpPacket) (result []byte, err error) {
+	payload := packet.Payload
+	if len(payload) < 1 {
+		return nil, errors.New("vp8, empty payload")
+	}
+
+	lost := c.started && packet.SequenceNumber != c.lastSeq+1
+	c.lastSeq = packet.SequenceNumber
+	c.started = true
+
+	start := payload[0]&0x10 == 0x10 && payload[0]&0x07 == 0
+	pictureId := -1
+	offset := 1
+	if payload[0]&0x80 == 0x80 {
+		if len(payload) < 2 {
+			return nil, errors.New("vp8, payload too short for extension")
+		}
+		extension := payload[1]
+		offset++
+		if extension&0x80 == 0x80 {
+			if len(payload) < offset+1 {
+				return nil, errors.New("vp8, payload too short for picture ID")
+			}
+			if payload[offset]&0x80 == 0x80 {
+				if len(payload) < offset+2 {
+					return nil, errors.New("vp8, payload too short for picture ID")
+				}
+				pictureId = int(binary.BigEndian.Uint16(payload[offset:]) & 0x7FFF)
+				c.pictureIdBits = 15
+				offset += 2
+			} else {
+				pictureId = int(payload[offset])
+				c.pictureIdBits = 7
+				offset++
+			}
+		}
+		if extension&0x40 == 0x40 {
+			offset++
+		}
+		if extension&0x30 != 0 {
+			offset++
+		}
+	}
+	if len(payload) <= offset {
+		return nil, errors.New("vp8, payload too short for descriptor")
+	}
+	data := payload[offset:]
+
+	if start {
+		// without an end of partition bit, a frame still assembling lost its tail with the marker bit
+		c.complete = false
+		result = c.endFrame("next frame started before marker bit")
+		c.startFrame(packet, pictureId, data)
+	} else if !c.assembling {
+		return nil, errors.New("vp8, packet without frame start")
+	} else if lost || packet.Timestamp != c.timestamp {
+		c.complete = false
+	}
+	c.frame = append(c.frame, data...)
+
+	if packet.Marker {
+		result = append(result, c.endFrame("lost packets")...)
+	}
+	return result, nil
+}
+
+func (c *Vp8) startFrame(packet *rtp.RtpPacket, pictureId int, data []byte) {
+	c.assembling = true
+	c.complete = true
+	c.timestamp = packet.Timestamp
+	c.frame = nil
+
+	// frames in between were lost when picture IDs are not consecutive
+	if pictureId >= 0 && c.lastPictureId >= 0 {
+		mask := 1<<uint(c.pictureIdBits) - 1
+		if missing := (pictureId - c.lastPictureId - 1) & mask; missing > 0 {
+			log.Sdebug("vp8, %d frames lost before picture id:%d", missing, pictureId)
+			c.lostFrames += missing
+		}
+	}
+	c.lastPictureId = pictureId
+
+	// frame tag := [size0(3)][show_frame][version(3)][P], key frames follow with start code 9d 01 2a and size
+	c.keyFrame = data[0]&0x01 == 0
+	if c.keyFrame && len(data) >= 10 && data[3] == 0x9D && data[4] == 0x01 && data[5] == 0x2A {
+		c.ivf.width = int(binary.LittleEndian.Uint16(data[6:]) & 0x3FFF)
+		c.ivf.height = int(binary.LittleEndian.Uint16(data[8:]) & 0x3FFF)
+	}
+	log.Sdebug("vp8, seq:%d, frame start, key:%t, picture id:%d", packet.SequenceNumber, c.keyFrame, pictureId)
+}
+
+// endFrame writes the frame being assembled, frames missing packets are dropped
+func (c *Vp8) endFrame(reason string) []byte {
+	if !c.assembling {
+		return nil
+	}
+	c.assembling = false
+	if !c.complete {
+		log.Swarn("vp8, incomplete frame dropped, %s", reason)
+		c.droppedFrames++
+		return nil
+	}
+	if c.keyFrame {
+		c.keyFrames++
+	}
+	return c.ivf.frame(c.timestamp, c.frame)
+}
+
+// Flush drops a frame cut by the end of the stream, its marker bit was not received
+func (c *Vp8) Flush() []byte {
+	c.complete = false
+	return c.endFrame("stream ended")
+}
+
+var Vp8Metadata = CodecMetadata{
+	Name:     "vp8",
+	LongName: "VP8",
+	Options:  []CodecOption{},
+	Init:     NewVp8,
+}
@@ -0,0 +1,286 @@
+package codecs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/hdiniz/rtpdump/log"
+	"github.com/hdiniz/rtpdump/rtp"
+)
+
+// VP9 payload descriptor, draft-ietf-payload-vp9
+// [I][P][L][F][B][E][V][Z], followed by picture ID (7 or 15 bits), layer indices,
+// reference indices (P_DIFF) in flexible mode and the scalability structure (SS)
+// B and E flag the start and end of a layer frame, the marker bit the end of a picture
+
+// superframe index marker, 4 octet frame sizes
+const VP9_SUPERFRAME_MARKER = 0xD8
+
+const VP9_MAX_SUPERFRAME_FRAMES = 8
+
+type Vp9 struct {
+	ivf ivfWriter
+
+	started bool
+	lastSeq uint16
+
+	// picture holds layer frames sharing a timestamp, written as one superframe
+	picture         [][]byte
+	pictureComplete bool
+	timestamp       uint32
+	keyFrame        bool
+
+	assembling bool
+	frame      []byte
+
+	keyFrames     int
+	droppedFrames int
+}
+
+func NewVp9() Codec {
+	return &Vp9{ivf: ivfWriter{fourcc: "VP90"}}
+}
+
+func (c *Vp9) Init() {
+}
+
+func (c *Vp9) SetOptions(options map[string]string) error {
+	return nil
+}
+
+// GetFormatMagic returns the IVF header, frame count and size are only known once done
+func (c Vp9) GetFormatMagic() []byte {
+	return c.ivf.header()
+}
+
+func (c *Vp9) GetFinalFormatMagic() []byte {
+	return c.ivf.header()
+}
+
+func (c *Vp9) GetAnalysis() string {
+	return fmt.Sprintf("Resolution: %dx%d\nPictures: %d\nKey pictures: %d\nIncomplete pictures dropped: %d\n",
+		c.ivf.width, c.ivf.height, c.ivf.frames, c.keyFrames, c.droppedFrames)
+}
+
+func (c *Vp9) HandleRtpPacket(packet *rtp.RtpPacket) (result []byte, err error) {
+	payload := packet.Payload
+	if len(payload) < 1 {
+		return nil, errors.New("vp9, empty payload")
+	}
+
+	lost := c.started && packet.SequenceNumber != c.lastSeq+1
+	c.lastSeq = packet.SequenceNumber
+	c.started = true
+
+	descriptor := payload[0]
+	interPredicted := descriptor&0x40 == 0x40
+	begin := descriptor&0x08 == 0x08
+	end := descriptor&0x04 == 0x04
+	spatialLayer := 0
+
+	offset := 1
+	if descriptor&0x80 == 0x80 {
+		// picture ID, M set for 15 bits
+		if len(payload) > offset && payload[offset]&0x80 == 0x80 {
+			offset += 2
+		} else {
+			offset++
+		}
+	}
+	if descriptor&0x20 == 0x20 {
+		// layer indices := [TID(3)][U][SID(3)][D], TL0PICIDX(8) in non-flexible mode
+		if len(payload) > offset {
+			spatialLayer = int(payload[offset] >> 1 & 0x07)
+		}
+		offset++
+		if descriptor&0x10 == 0 {
+			offset++
+		}
+	}
+	if descriptor&0x10 == 0x10 && interPredicted {
+		// up to 3 reference indices := [P_DIFF(7)][N]
+		for i := 0; i < 3 && len(payload) > offset; i++ {
+			offset++
+			if payload[offset-1]&0x01 == 0 {
+				break
+			}
+		}
+	}
+	if descriptor&0x02 == 0x02 {
+		if offset, err = c.handleScalabilityStructure(payload, offset); err != nil {
+			return nil, err
+		}
+	}
+	if len(payload) <= offset {
+		return nil, errors.New("vp9, payload too short for descriptor")
+	}
+	data := payload[offset:]
+
+	if c.picture != nil && packet.Timestamp != c.timestamp {
+		result = c.endPicture("next picture started before marker bit")
+	}
+	if c.picture == nil {
+		c.picture = [][]byte{}
+		c.pictureComplete = true
+		c.timestamp = packet.Timestamp
+		c.keyFrame = false
+	} else if lost {
+		c.pictureComplete = false
+	}
+
+	if begin {
+		if c.assembling {
+			c.pictureComplete = false
+		}
+		c.assembling = true
+		c.frame = nil
+		if !interPredicted && spatialLayer == 0 {
+			c.keyFrame = true
+			c.readFrameSize(data)
+		}
+	} else if !c.assembling {
+		c.pictureComplete = false
+		return result, errors.New("vp9, packet without frame start")
+	}
+	c.frame = append(c.frame, data...)
+
+	if end {
+		c.assembling = false
+		c.picture = append(c.picture, c.frame)
+	}
+	log.Sdebug("vp9, seq:%d, b:%t, e:%t, sid:%d, key:%t", packet.SequenceNumber, begin, end, spatialLayer, c.keyFrame)
+
+	if packet.Marker {
+		result = append(result, c.endPicture("lost packets")...)
+	}
+	return result, nil
+}
+
+// handleScalabilityStructure reads the frame size of the highest spatial layer, returns the offset following SS
+// SS := [N_S(3)][Y][G][RSV(3)], [WIDTH(16)][HEIGHT(16)] per layer when Y, N_G(8) and picture group descriptions when G
+func (c *Vp9) handleScalabilityStructure(payload []byte, offset int) (int, error) {
+	if len(payload) <= offset {
+		return offset, errors.New("vp9, payload too short for scalability structure")
+	}
+	layers := int(payload[offset]>>5) + 1
+	hasSizes := payload[offset]&0x10 == 0x10
+	hasGroup := payload[offset]&0x08 == 0x08
+	offset++
+	if hasSizes {
+		if len(payload) < offset+4*layers {
+			return offset, errors.New("vp9, payload too short for scalability structure")
+		}
+		last := offset + 4*(layers-1)
+		c.ivf.width = int(binary.BigEndian.Uint16(payload[last:]))
+		c.ivf.height = int(binary.BigEndian.Uint16(payload[last+2:]))
+		offset += 4 * layers
+	}
+	if hasGroup {
+		if len(payload) <= offset {
+			return offset, errors.New("vp9, payload too short for scalability structure")
+		}
+		groups := int(payload[offset])
+		offset++
+		for i := 0; i < groups; i++ {
+			// [TID(3)][U][R(2)][RSV(2)] and R reference indices
+			if len(payload) <= offset {
+				return offset, errors.New("vp9, payload too short for scalability structure")
+			}
+			offset += 1 + int(payload[offset]>>2&0x03)
+		}
+	}
+	return offset, nil
+}
+
+// readFrameSize reads the key frame uncompressed header, unless the scalability structure gave the size
+func (c *Vp9) readFrameSize(data []byte) {
+	// 72 bits up to frame_height_minus_1 at most
+	if c.ivf.width > 0 || len(data) < 9 {
+		return
+	}
+	r := newBitReader(data)
+	read := func(n int) uint {
+		v, _ := r.readBits(n)
+		return v
+	}
+	// frame_marker, profile, show_existing_frame, frame_type, show_frame, error_resilient_mode
+	if read(2) != 2 {
+		return
+	}
+	profile := read(1) | read(1)<<1
+	if profile == 3 {
+		read(1)
+	}
+	if read(1) == 1 || read(1) != 0 {
+		return
+	}
+	read(2)
+	if read(24) != 0x498342 {
+		return
+	}
+	// color_config
+	if profile >= 2 {
+		read(1)
+	}
+	if read(3) != 7 {
+		read(1)
+		if profile == 1 || profile == 3 {
+			read(3)
+		}
+	} else if profile == 1 || profile == 3 {
+		read(1)
+	}
+	c.ivf.width, c.ivf.height = int(read(16)+1), int(read(16)+1)
+}
+
+// endPicture writes the layer frames of a picture, a superframe index is appended
+// when there is more than one. Pictures missing packets are dropped
+func (c *Vp9) endPicture(reason string) (result []byte) {
+	picture := c.picture
+	c.picture = nil
+	if c.assembling {
+		c.assembling = false
+		c.pictureComplete = false
+	}
+	if !c.pictureComplete || len(picture) == 0 || len(picture) > VP9_MAX_SUPERFRAME_FRAMES {
+		log.Swarn("vp9, incomplete picture dropped, %s", reason)
+		c.droppedFrames++
+		return nil
+	}
+	if c.keyFrame {
+		c.keyFrames++
+	}
+
+	var data []byte
+	for _, v := range picture {
+		data = append(data, v...)
+	}
+	if len(picture) > 1 {
+		marker := byte(VP9_SUPERFRAME_MARKER | len(picture) - 1)
+		data = append(data, marker)
+		for _, v := range picture {
+			size := make([]byte, 4)
+			binary.LittleEndian.PutUint32(size, uint32(len(v)))
+			data = append(data, size...)
+		}
+		data = append(data, marker)
+	}
+	return c.ivf.frame(c.timestamp, data)
+}
+
+// Flush writes a picture cut by the end of the stream, its marker bit was not received
+func (c *Vp9) Flush() []byte {
+	if c.picture == nil {
+		return nil
+	}
+	c.pictureComplete = false
+	return c.endPicture("stream ended")
+}
+
+var Vp9Metadata = CodecMetadata{
+	Name:     "vp9",
+	LongName: "VP9",
+	Options:  []CodecOption{},
+	Init:     NewVp9,
+}
@@ -0,0 +1,64 @@
+package codecs
+
+import (
+	"encoding/binary"
+)
+
+const WAVE_FORMAT_PCM = 1
+const WAVE_FORMAT_ALAW = 6
+const WAVE_FORMAT_MULAW = 7
+
+type wavFormat struct {
+	formatTag     int
+	channels      int
+	sampleRate    int
+	bitsPerSample int
+}
+
+// header builds the RIFF header for dataSize bytes of samples,
+// non-PCM formats carry the extended fmt chunk and a fact chunk
+func (f wavFormat) header(dataSize int) []byte {
+	blockAlign := f.channels * f.bitsPerSample / 8
+
+	fmtChunk := make([]byte, 16)
+	binary.LittleEndian.PutUint16(fmtChunk[0:], uint16(f.formatTag))
+	binary.LittleEndian.PutUint16(fmtChunk[2:], uint16(f.channels))
+	binary.LittleEndian.PutUint32(fmtChunk[4:], uint32(f.sampleRate))
+	binary.LittleEndian.PutUint32(fmtChunk[8:], uint32(f.sampleRate*blockAlign))
+	binary.LittleEndian.PutUint16(fmtChunk[12:], uint16(blockAlign))
+	binary.LittleEndian.PutUint16(fmtChunk[14:], uint16(f.bitsPerSample))
+
+	var chunks []byte
+	if f.formatTag == WAVE_FORMAT_PCM {
+		chunks = append(chunks, riffChunk("fmt ", fmtChunk)...)
+	} else {
+		chunks = append(chunks, riffChunk("fmt ", append(fmtChunk, 0x00, 0x00))...)
+		fact := make([]byte, 4)
+		if blockAlign > 0 {
+			binary.LittleEndian.PutUint32(fact, uint32(dataSize/blockAlign))
+		}
+		chunks = append(chunks, riffChunk("fact", fact)...)
+	}
+
+	dataHeader := make([]byte, 8)
+	copy(dataHeader, "data")
+	binary.LittleEndian.PutUint32(dataHeader[4:], uint32(dataSize))
+	chunks = append(chunks, dataHeader...)
+
+	result := make([]byte, 12)
+	copy(result, "RIFF")
+	binary.LittleEndian.PutUint32(result[4:], uint32(4+len(chunks)+dataSize))
+	copy(result[8:], "WAVE")
+	return append(result, chunks...)
+}
+
+func riffChunk(id string, data []byte) []byte {
+	result := make([]byte, 8)
+	copy(result, id)
+	binary.LittleEndian.PutUint32(result[4:], uint32(len(data)))
+	return append(result, data...)
+}
+
+func appendSample16(result []byte, sample int16) []byte {
+	return append(result, byte(uint16(sample)), byte(uint16(sample)>>8))
+}
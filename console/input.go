@@ -2,6 +2,8 @@ package console
 
 import (
   "fmt"
+  "io"
+  "os"
   "strings"
 )
 
@@ -71,6 +73,62 @@ func ExpectRestrictedString(values []string, print PrintFunction) (value string,
   return
 }
 
+// ExpectOptionalString accepts any line, including an empty one
+func ExpectOptionalString(print PrintFunction) (value string, err error) {
+  if err = print(0); err != nil {
+    return
+  }
+  return readLine()
+}
+
+// ExpectOptionalRestrictedString accepts an empty line or one of values
+func ExpectOptionalRestrictedString(values []string, print PrintFunction) (value string, err error) {
+  attempts := 0
+  for ; ; {
+    if err = print(attempts); err != nil {
+      return
+    }
+
+    fmt.Printf(": ")
+    if value, err = readLine(); err != nil {
+      return
+    }
+
+    if value == "" {
+      return
+    }
+    for _,v :=range values {
+      if v == value {
+        return
+      }
+    }
+
+    attempts++
+  }
+}
+
+// readLine reads stdin unbuffered so it can be mixed with fmt.Scan calls
+func readLine() (string, error) {
+  var line []byte
+  b := make([]byte, 1)
+  for {
+    n, err := os.Stdin.Read(b)
+    if n > 0 {
+      if b[0] == '\n' {
+        break
+      }
+      line = append(line, b[0])
+    }
+    if err != nil {
+      if err == io.EOF && len(line) > 0 {
+        break
+      }
+      return "", err
+    }
+  }
+  return strings.TrimSpace(string(line)), nil
+}
+
 func Prompt(prompt string) PrintFunction {
   return func (attempts int) error {
     fmt.Printf(prompt)
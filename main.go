@@ -2,8 +2,11 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -183,11 +186,302 @@ var dumpCmd = func(c *cli.Context) error {
 }
 
 func doInteractiveDump(c *cli.Context, rtpReader *rtp.RtpReader) error {
+	stream, err := chooseStream(rtpReader.GetStreams())
+
+	if err != nil || stream == nil {
+		return err
+	}
+
+	codecMetadata, options, err := chooseCodec()
+
+	if err != nil {
+		return err
+	}
+
+	codec, err := newCodec(codecMetadata, options)
+
+	if err != nil {
+		return err
+	}
+
+	red, err := chooseRed(stream, codec)
+
+	if err != nil {
+		return err
+	}
+
+	redPayloadType := -1
+	if red != nil {
+		redPayloadType = red.GetPayloadType()
+	}
+	ulpfec, err := chooseUlpfec(stream, redPayloadType)
+
+	if err != nil {
+		return err
+	}
+
+	if err = confirmFlexFec(stream); err != nil {
+		return err
+	}
+
+	rtxPayloadTypes, err := chooseRtx(stream)
+
+	if err != nil {
+		return err
+	}
+
+	stream, repair := repairStream(stream, redPayloadType, ulpfec, rtxPayloadTypes)
+
+	events, err := chooseTelephoneEvents(stream)
+
+	if err != nil {
+		return err
+	}
+
+	outputFile, err := console.ExpectAnyString(console.Prompt("Output file: "))
+
+	if err != nil {
+		return cli.NewMultiError(cli.NewExitError("invalid input", 1), err)
+	}
+
+	fmt.Printf("%s\n", outputFile)
+
+	f, err := os.Create(outputFile)
+	if err != nil {
+		return cli.NewMultiError(cli.NewExitError("failed to create file", 1), err)
+	}
+	defer f.Close()
+	f.Write(codec.GetFormatMagic())
+	for _, p := range stream.RtpPackets {
+		for _, r := range unwrapRed(red, p) {
+			if events != nil {
+				// events would corrupt the audio dump
+				if isEvent, _ := events.HandleRtpPacket(r); isEvent {
+					continue
+				}
+			}
+			frames, err := codec.HandleRtpPacket(r)
+			if err == nil {
+				f.Write(frames)
+			}
+		}
+	}
+	if flusher, ok := codec.(codecs.Flusher); ok {
+		f.Write(flusher.Flush())
+	}
+	if finalizer, ok := codec.(codecs.FormatMagicFinalizer); ok {
+		f.WriteAt(finalizer.GetFinalFormatMagic(), 0)
+	}
+	f.Sync()
+
+	if writer, ok := codec.(codecs.MetadataWriter); ok {
+		if err = writeMetadata(outputFile, writer); err != nil {
+			return err
+		}
+	}
+
+	if repair != nil {
+		fmt.Print(repair)
+	}
+	if red != nil {
+		fmt.Print(red.GetAnalysis())
+	}
+
+	if events != nil {
+		fmt.Print(events.GetAnalysis())
+		if err = writeMetadata(outputFile, events); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeMetadata(outputFile string, writer codecs.MetadataWriter) error {
+	metadata := writer.GetMetadata()
+	var extensions []string
+	for k := range metadata {
+		extensions = append(extensions, k)
+	}
+	sort.Strings(extensions)
+
+	for _, v := range extensions {
+		if len(metadata[v]) == 0 {
+			continue
+		}
+		metadataFile := outputFile + v
+		fmt.Printf("%s\n", metadataFile)
+		if err := ioutil.WriteFile(metadataFile, metadata[v], 0644); err != nil {
+			return cli.NewMultiError(cli.NewExitError("failed to write metadata", 1), err)
+		}
+	}
+	return nil
+}
+
+var analyzeCmd = func(c *cli.Context) error {
+
+	loadKeyFile(c)
+
+	inputFile := c.Args().First()
+
+	if inputFile == "" {
+		cli.ShowCommandHelp(c, "analyze")
+		return cli.NewExitError("wrong usage for analyze", 1)
+	}
+
+	rtpReader, err := rtp.NewRtpReader(inputFile)
+
+	if err != nil {
+		return cli.NewMultiError(cli.NewExitError("failed to open file", 1), err)
+	}
+
+	defer rtpReader.Close()
+
 	rtpStreams := rtpReader.GetStreams()
+	stream, err := chooseStream(rtpStreams)
+
+	if err != nil || stream == nil {
+		return err
+	}
+
+	codecMetadata, options, err := chooseCodec()
+
+	if err != nil {
+		return err
+	}
+
+	codec, err := newCodec(codecMetadata, options)
+
+	if err != nil {
+		return err
+	}
 
+	red, err := chooseRed(stream, codec)
+
+	if err != nil {
+		return err
+	}
+
+	redPayloadType := -1
+	if red != nil {
+		redPayloadType = red.GetPayloadType()
+	}
+	ulpfec, err := chooseUlpfec(stream, redPayloadType)
+
+	if err != nil {
+		return err
+	}
+
+	if err = confirmFlexFec(stream); err != nil {
+		return err
+	}
+
+	rtxPayloadTypes, err := chooseRtx(stream)
+
+	if err != nil {
+		return err
+	}
+
+	stream, repair := repairStream(stream, redPayloadType, ulpfec, rtxPayloadTypes)
+
+	events, err := chooseTelephoneEvents(stream)
+
+	if err != nil {
+		return err
+	}
+
+	analyzer, ok := codec.(codecs.Analyzer)
+	if !ok && events == nil {
+		fmt.Println("Codec does not support analysis")
+		return nil
+	}
+
+	analyzeStream(codec, stream, red, events)
+
+	fmt.Printf("%s\n", stream)
+	if ok {
+		fmt.Print(analyzer.GetAnalysis())
+	}
+	if repair != nil {
+		fmt.Print(repair)
+	}
+	if red != nil {
+		fmt.Print(red.GetAnalysis())
+	}
+	if events != nil {
+		fmt.Print(events.GetAnalysis())
+	}
+
+	forward, ok := codec.(codecs.ModeAdaptation)
+	reverseStream := findReverseStream(rtpStreams, stream)
+	if !ok || reverseStream == nil {
+		return nil
+	}
+
+	// mode requests are answered by the other direction, using the same codec options
+	reverseCodec, err := newCodec(codecMetadata, options)
+
+	if err != nil {
+		return err
+	}
+
+	var reverseRed *codecs.RedDecoder
+	if red != nil {
+		reverseRed = codecs.NewRedDecoder(red.GetPayloadType())
+	}
+	var reverseEvents *codecs.TelephoneEvents
+	if events != nil {
+		reverseEvents = codecs.NewTelephoneEvents(events.GetPayloadType(), events.GetClockRate())
+	}
+	reverseRtxPayloadTypes, _ := inferRtx(reverseStream)
+	reverseStream, _ = repairStream(reverseStream, redPayloadType, ulpfec, reverseRtxPayloadTypes)
+	analyzeStream(reverseCodec, reverseStream, reverseRed, reverseEvents)
+	reverse := reverseCodec.(codecs.ModeAdaptation)
+
+	fmt.Printf("\n%s\n", stream)
+	fmt.Print(codecs.ModeAdaptationAnalysis(forward, reverse))
+	fmt.Printf("\n%s\n", reverseStream)
+	fmt.Print(codecs.ModeAdaptationAnalysis(reverse, forward))
+
+	return nil
+}
+
+func analyzeStream(codec codecs.Codec, stream *rtp.RtpStream, red *codecs.RedDecoder, events *codecs.TelephoneEvents) {
+	for _, p := range stream.RtpPackets {
+		for _, r := range unwrapRed(red, p) {
+			if events != nil {
+				if isEvent, _ := events.HandleRtpPacket(r); isEvent {
+					continue
+				}
+			}
+			codec.HandleRtpPacket(r)
+		}
+	}
+	if flusher, ok := codec.(codecs.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// findReverseStream looks for the other direction of the session, preferring the same payload type
+func findReverseStream(rtpStreams []*rtp.RtpStream, stream *rtp.RtpStream) (reverse *rtp.RtpStream) {
+	for _, v := range rtpStreams {
+		if v.SrcIP == stream.DstIP && v.SrcPort == stream.DstPort &&
+			v.DstIP == stream.SrcIP && v.DstPort == stream.SrcPort {
+			if v.PayloadType == stream.PayloadType {
+				return v
+			}
+			if reverse == nil {
+				reverse = v
+			}
+		}
+	}
+	return reverse
+}
+
+func chooseStream(rtpStreams []*rtp.RtpStream) (*rtp.RtpStream, error) {
 	if len(rtpStreams) <= 0 {
 		fmt.Println("No streams found")
-		return nil
+		return nil, nil
 	}
 
 	var rtpStreamsOptions []string
@@ -201,10 +495,283 @@ func doInteractiveDump(c *cli.Context, rtpReader *rtp.RtpReader) error {
 		console.ListPrompt("Choose RTP Stream", rtpStreamsOptions...))
 
 	if err != nil {
-		return cli.NewMultiError(cli.NewExitError("invalid input", 1), err)
+		return nil, cli.NewMultiError(cli.NewExitError("invalid input", 1), err)
 	}
 	fmt.Printf("(%-3d) %s\n\n", streamIndex, rtpStreams[streamIndex-1])
 
+	return rtpStreams[streamIndex-1], nil
+}
+
+// unwrapRed returns the packet as it is, or its RED blocks with packets recovered from redundancy first
+func unwrapRed(red *codecs.RedDecoder, packet *rtp.RtpPacket) []*rtp.RtpPacket {
+	if red == nil {
+		return []*rtp.RtpPacket{packet}
+	}
+	packets, err := red.Unwrap(packet)
+	if err != nil {
+		log.Sdebug("%s", err)
+	}
+	return packets
+}
+
+// chooseRed asks for the RFC 2198 redundancy payload type when the stream carries more than one,
+// or when all its packets parse as RED around a single other payload type. nil when there is none
+func chooseRed(stream *rtp.RtpStream, codec codecs.Codec) (*codecs.RedDecoder, error) {
+	counts := make(map[int]int)
+	primaries := make(map[int]bool)
+	parsed := 0
+	for _, r := range stream.RtpPackets {
+		counts[r.PayloadType]++
+		if blocks, err := rtp.ParseRed(r.Payload); err == nil && blocks[len(blocks)-1].PayloadType != r.PayloadType {
+			primaries[blocks[len(blocks)-1].PayloadType] = true
+			parsed++
+		}
+	}
+	if len(counts) == 1 && (parsed < len(stream.RtpPackets) || len(primaries) != 1) {
+		return nil, nil
+	}
+
+	var sorted []int
+	for k := range counts {
+		sorted = append(sorted, k)
+	}
+	sort.Ints(sorted)
+	var payloadTypes []string
+	var packetCounts []string
+	for _, v := range sorted {
+		payloadTypes = append(payloadTypes, strconv.Itoa(v))
+		packetCounts = append(packetCounts, fmt.Sprintf("%d packets", counts[v]))
+	}
+
+	value, err := console.ExpectOptionalRestrictedString(
+		payloadTypes,
+		console.KeyValuePrompt("red - payload type of RFC 2198 redundancy (optional)",
+			payloadTypes, packetCounts))
+
+	if err != nil {
+		return nil, cli.NewMultiError(cli.NewExitError("invalid input", 1), err)
+	}
+	if value == "" {
+		return nil, nil
+	}
+	payloadType, _ := strconv.Atoi(value)
+
+	red := codecs.NewRedDecoder(payloadType)
+	if handler, ok := codec.(codecs.EmptyPayloadHandler); ok {
+		red.SetKeepEmpty(handler.HandlesEmptyPayload())
+	}
+	return red, nil
+}
+
+// chooseUlpfec asks for the RFC 5109 FEC payload type when the stream carries payload types
+// other than its media one, looking into RED blocks too. -1 when there is none
+func chooseUlpfec(stream *rtp.RtpStream, redPayloadType int) (int, error) {
+	counts := make(map[int]int)
+	media := stream.PayloadType
+	for _, r := range stream.RtpPackets {
+		payloadType := r.PayloadType
+		if payloadType == redPayloadType {
+			if blocks, err := rtp.ParseRed(r.Payload); err == nil {
+				payloadType = blocks[len(blocks)-1].PayloadType
+			}
+		}
+		counts[payloadType]++
+		if counts[payloadType] > counts[media] {
+			media = payloadType
+		}
+	}
+
+	var sorted []int
+	for k := range counts {
+		if k != media {
+			sorted = append(sorted, k)
+		}
+	}
+	if len(sorted) == 0 {
+		return -1, nil
+	}
+	sort.Ints(sorted)
+	var payloadTypes []string
+	var packetCounts []string
+	for _, v := range sorted {
+		payloadTypes = append(payloadTypes, strconv.Itoa(v))
+		packetCounts = append(packetCounts, fmt.Sprintf("%d packets", counts[v]))
+	}
+
+	value, err := console.ExpectOptionalRestrictedString(
+		payloadTypes,
+		console.KeyValuePrompt("ulpfec - payload type of RFC 5109 FEC (optional)",
+			payloadTypes, packetCounts))
+
+	if err != nil {
+		return -1, cli.NewMultiError(cli.NewExitError("invalid input", 1), err)
+	}
+	if value == "" {
+		return -1, nil
+	}
+	payloadType, _ := strconv.Atoi(value)
+	return payloadType, nil
+}
+
+// inferRtx maps RTX payload types to the original ones (apt), from retransmissions of packets
+// received too, or to the only payload type of the stream. Those left unmapped are returned
+func inferRtx(stream *rtp.RtpStream) (map[int]int, []int) {
+	if stream.Rtx == nil {
+		return nil, nil
+	}
+	payloadTypes := make(map[int]bool)
+	for _, r := range stream.RtpPackets {
+		payloadTypes[r.PayloadType] = true
+	}
+
+	apt := stream.RtxPayloadTypes()
+	var unmapped []int
+	seen := make(map[int]bool)
+	for _, r := range stream.Rtx.RtpPackets {
+		// padding only packets are bandwidth probes
+		if _, ok := apt[r.PayloadType]; ok || seen[r.PayloadType] || len(r.Payload) < 2 {
+			continue
+		}
+		if len(payloadTypes) == 1 {
+			apt[r.PayloadType] = stream.PayloadType
+			continue
+		}
+		seen[r.PayloadType] = true
+		unmapped = append(unmapped, r.PayloadType)
+	}
+	sort.Ints(unmapped)
+	return apt, unmapped
+}
+
+// chooseRtx asks for the original payload type of RTX payload types that could not be inferred
+func chooseRtx(stream *rtp.RtpStream) (map[int]int, error) {
+	apt, unmapped := inferRtx(stream)
+	if len(unmapped) == 0 {
+		return apt, nil
+	}
+
+	counts := make(map[int]int)
+	for _, r := range stream.RtpPackets {
+		counts[r.PayloadType]++
+	}
+	var sorted []int
+	for k := range counts {
+		sorted = append(sorted, k)
+	}
+	sort.Ints(sorted)
+	var payloadTypes []string
+	var packetCounts []string
+	for _, v := range sorted {
+		payloadTypes = append(payloadTypes, strconv.Itoa(v))
+		packetCounts = append(packetCounts, fmt.Sprintf("%d packets", counts[v]))
+	}
+
+	for _, v := range unmapped {
+		value, err := console.ExpectOptionalRestrictedString(
+			payloadTypes,
+			console.KeyValuePrompt(
+				fmt.Sprintf("rtx - original payload type (apt) of RTX payload type %d (optional)", v),
+				payloadTypes, packetCounts))
+
+		if err != nil {
+			return nil, cli.NewMultiError(cli.NewExitError("invalid input", 1), err)
+		}
+		if value == "" {
+			continue
+		}
+		apt[v], _ = strconv.Atoi(value)
+	}
+	return apt, nil
+}
+
+// confirmFlexFec asks whether a stream listing the chosen one as CSRC, without looking
+// like FlexFEC, is used to repair it. Mixers list contributing sources the same way
+func confirmFlexFec(stream *rtp.RtpStream) error {
+	candidate := stream.FlexFecCandidate
+	if stream.FlexFec != nil || candidate == nil {
+		return nil
+	}
+
+	value, err := console.ExpectOptionalRestrictedString(
+		[]string{"y", "n"},
+		console.Prompt(fmt.Sprintf(
+			"flexfec - 0x%08X lists this stream as CSRC, repair from it as FlexFEC? [y/n] (optional)",
+			candidate.Ssrc)))
+
+	if err != nil {
+		return cli.NewMultiError(cli.NewExitError("invalid input", 1), err)
+	}
+	if value == "y" {
+		stream.FlexFec = candidate
+		candidate.RepairOf = stream
+	}
+	return nil
+}
+
+// repairStream merges packets recovered from RTX, ULPFEC and FlexFEC into the stream,
+// the report is nil when there is nothing to repair it from
+func repairStream(stream *rtp.RtpStream, redPayloadType int, ulpfecPayloadType int, rtxPayloadTypes map[int]int) (*rtp.RtpStream, *rtp.RepairReport) {
+	if stream.Rtx == nil && stream.FlexFec == nil && ulpfecPayloadType < 0 {
+		return stream, nil
+	}
+	repaired, report := stream.Repair(redPayloadType, ulpfecPayloadType, rtxPayloadTypes)
+	return repaired, &report
+}
+
+// chooseTelephoneEvents asks for the negotiated telephone-event payload type
+// when the stream carries more than one, nil when there is none
+func chooseTelephoneEvents(stream *rtp.RtpStream) (*codecs.TelephoneEvents, error) {
+	var payloadTypes []string
+	var packetCounts []string
+	counts := make(map[int]int)
+	for _, r := range stream.RtpPackets {
+		if r.PayloadType == stream.PayloadType {
+			continue
+		}
+		if counts[r.PayloadType] == 0 {
+			payloadTypes = append(payloadTypes, strconv.Itoa(r.PayloadType))
+		}
+		counts[r.PayloadType]++
+	}
+	if len(payloadTypes) == 0 {
+		return nil, nil
+	}
+	for _, v := range payloadTypes {
+		payloadType, _ := strconv.Atoi(v)
+		packetCounts = append(packetCounts, fmt.Sprintf("%d packets", counts[payloadType]))
+	}
+
+	value, err := console.ExpectOptionalRestrictedString(
+		payloadTypes,
+		console.KeyValuePrompt("telephone-event - payload type of DTMF events (optional)",
+			payloadTypes, packetCounts))
+
+	if err != nil {
+		return nil, cli.NewMultiError(cli.NewExitError("invalid input", 1), err)
+	}
+	if value == "" {
+		return nil, nil
+	}
+	payloadType, _ := strconv.Atoi(value)
+
+	value, err = console.ExpectOptionalString(
+		console.Prompt(fmt.Sprintf("telephone-event - clock rate, empty for %d (optional): ",
+			codecs.TELEPHONE_EVENT_DEFAULT_CLOCK_RATE)))
+
+	if err != nil {
+		return nil, cli.NewMultiError(cli.NewExitError("invalid input", 1), err)
+	}
+	clockRate := 0
+	if value != "" {
+		if clockRate, err = strconv.Atoi(value); err != nil {
+			return nil, cli.NewMultiError(cli.NewExitError("invalid input", 1), err)
+		}
+	}
+
+	return codecs.NewTelephoneEvents(payloadType, clockRate), nil
+}
+
+func chooseCodec() (codecs.CodecMetadata, map[string]string, error) {
 	var codecList []string
 	for _, v := range codecs.CodecList {
 		codecList = append(codecList, v.Name)
@@ -215,7 +782,7 @@ func doInteractiveDump(c *cli.Context, rtpReader *rtp.RtpReader) error {
 		console.ListPrompt("Choose codec:", codecList...))
 
 	if err != nil {
-		return cli.NewMultiError(cli.NewExitError("invalid input", 1), err)
+		return codecs.CodecMetadata{}, nil, cli.NewMultiError(cli.NewExitError("invalid input", 1), err)
 	}
 	fmt.Printf("(%-3d) %s\n\n", codecIndex, codecs.CodecList[codecIndex-1].Name)
 
@@ -224,51 +791,47 @@ func doInteractiveDump(c *cli.Context, rtpReader *rtp.RtpReader) error {
 	optionsMap := make(map[string]string)
 	for _, v := range codecMetadata.Options {
 		var optionValue string
-		if v.RestrictValues {
+		switch {
+		case v.RestrictValues && v.Required:
 			optionValue, err = console.ExpectRestrictedString(
 				v.ValidValues,
 				console.KeyValuePrompt(fmt.Sprintf("%s - %s", v.Name, v.Description),
 					v.ValidValues, v.ValueDescription))
-		} else {
+		case v.RestrictValues:
+			optionValue, err = console.ExpectOptionalRestrictedString(
+				v.ValidValues,
+				console.KeyValuePrompt(fmt.Sprintf("%s - %s (optional)", v.Name, v.Description),
+					v.ValidValues, v.ValueDescription))
+		case v.Required:
 			optionValue, err = console.ExpectAnyString(
 				console.Prompt(fmt.Sprintf("%s - %s: ", v.Name, v.Description)))
+		default:
+			optionValue, err = console.ExpectOptionalString(
+				console.Prompt(fmt.Sprintf("%s - %s (optional): ", v.Name, v.Description)))
 		}
 
 		if err != nil {
-			return cli.NewMultiError(cli.NewExitError("invalid input", 1), err)
+			return codecs.CodecMetadata{}, nil, cli.NewMultiError(cli.NewExitError("invalid input", 1), err)
+		}
+		if optionValue != "" {
+			optionsMap[v.Name] = optionValue
 		}
-		optionsMap[v.Name] = optionValue
-	}
-
-	outputFile, err := console.ExpectAnyString(console.Prompt("Output file: "))
-
-	if err != nil {
-		return cli.NewMultiError(cli.NewExitError("invalid input", 1), err)
 	}
 
-	fmt.Printf("%s\n", outputFile)
+	return codecMetadata, optionsMap, nil
+}
 
+func newCodec(codecMetadata codecs.CodecMetadata, options map[string]string) (codecs.Codec, error) {
 	codec := codecMetadata.Init()
-	err = codec.SetOptions(optionsMap)
+	err := codec.SetOptions(options)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	codec.Init()
 
-	f, err := os.Create(outputFile)
-	defer f.Close()
-	f.Write(codec.GetFormatMagic())
-	for _, r := range rtpStreams[streamIndex-1].RtpPackets {
-		frames, err := codec.HandleRtpPacket(r)
-		if err == nil {
-			f.Write(frames)
-		}
-	}
-	f.Sync()
-
-	return nil
+	return codec, nil
 }
 
 func codecsList(c *cli.Context) error {
@@ -316,6 +879,13 @@ func main() {
 			ArgsUsage: "[pcap-file]",
 			Action:    dumpCmd,
 		},
+		{
+			Name:      "analyze",
+			Aliases:   []string{"a"},
+			Usage:     "analyzes rtp payload of a stream",
+			ArgsUsage: "[pcap-file]",
+			Action:    analyzeCmd,
+		},
 		{
 			Name:      "play",
 			Aliases:   []string{"p"},
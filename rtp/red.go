@@ -0,0 +1,49 @@
+package rtp
+
+import (
+	"errors"
+)
+
+// RFC 2198 - redundant payload data
+// block header := [F(1)][block PT(7)][timestamp offset(14)][block length(10)], the last one := [0][block PT(7)]
+// data blocks follow in the same order, oldest redundant block first and the primary block last
+
+type RedBlock struct {
+	PayloadType     int
+	TimestampOffset uint32
+	Payload         []byte
+}
+
+func ParseRed(payload []byte) (blocks []RedBlock, err error) {
+	offset := 0
+	for {
+		if offset >= len(payload) {
+			return nil, errors.New("red, payload too short for block header")
+		}
+		if payload[offset]&0x80 == 0 {
+			blocks = append(blocks, RedBlock{PayloadType: int(payload[offset] & 0x7F)})
+			offset++
+			break
+		}
+		if offset+4 > len(payload) {
+			return nil, errors.New("red, payload too short for block header")
+		}
+		blocks = append(blocks, RedBlock{
+			PayloadType:     int(payload[offset] & 0x7F),
+			TimestampOffset: uint32(payload[offset+1])<<6 | uint32(payload[offset+2]>>2),
+			Payload:         make([]byte, int(payload[offset+2]&0x03)<<8|int(payload[offset+3])),
+		})
+		offset += 4
+	}
+
+	for i := range blocks[:len(blocks)-1] {
+		size := len(blocks[i].Payload)
+		if offset+size > len(payload) {
+			return nil, errors.New("red, block length exceeds payload")
+		}
+		blocks[i].Payload = payload[offset : offset+size]
+		offset += size
+	}
+	blocks[len(blocks)-1].Payload = payload[offset:]
+	return blocks, nil
+}
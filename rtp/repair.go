@@ -0,0 +1,510 @@
+package rtp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/hdiniz/rtpdump/log"
+)
+
+// Stream repair, packets missing from a stream are recovered from
+// RFC 4588 - RTX, retransmissions in a stream of their own, payload := [OSN(16)][original payload]
+// RFC 5109 - ULPFEC, FEC packets within the protected stream under their own payload type, possibly in RED
+// RFC 8627 - FlexFEC, FEC packets in a stream of their own listing the protected SSRC as CSRC
+// FEC recovers a packet when it is the only one missing among those protected, XOR of all the others
+
+// share of RTX packets that must carry sequence numbers of a stream for it to be associated
+const RTX_ASSOCIATION_RATIO = 0.8
+
+type RepairReport struct {
+	RecoveredRtx     int
+	Retransmitted    int
+	FecPackets       int
+	RecoveredFec     int
+	UnrecoverableFec int
+}
+
+func (r RepairReport) String() string {
+	return fmt.Sprintf("Packets recovered from RTX: %d\nRetransmissions of received packets: %d\nFEC packets: %d\nPackets recovered from FEC: %d\nFEC packets missing more than one packet: %d\n",
+		r.RecoveredRtx, r.Retransmitted, r.FecPackets, r.RecoveredFec, r.UnrecoverableFec)
+}
+
+// AssociateRepairStreams links RTX and FlexFEC streams to the stream they repair. FlexFEC streams
+// list it as CSRC, RTX streams share its addresses and carry its sequence numbers and timestamps
+func AssociateRepairStreams(streams []*RtpStream) {
+	bySsrc := make(map[uint32]*RtpStream)
+	for _, v := range streams {
+		bySsrc[v.Ssrc] = v
+	}
+
+	for _, candidate := range streams {
+		protected := make(map[uint32]int)
+		for _, p := range candidate.RtpPackets {
+			if p.CC > 0 {
+				protected[p.Csrc[0]]++
+			}
+		}
+		for ssrc, count := range protected {
+			primary, ok := bySsrc[ssrc]
+			if !ok || primary == candidate || primary.FlexFec != nil || 2*count <= len(candidate.RtpPackets) {
+				continue
+			}
+			// mixers list contributing sources as CSRC too, those are left for the user to confirm
+			if !flexFecMatches(candidate, primary) {
+				log.Sdebug("flexfec, 0x%08X lists 0x%08X as CSRC, not associated", candidate.Ssrc, primary.Ssrc)
+				primary.FlexFecCandidate = candidate
+				continue
+			}
+			log.Sdebug("flexfec, 0x%08X protects 0x%08X", candidate.Ssrc, primary.Ssrc)
+			primary.FlexFec = candidate
+			candidate.RepairOf = primary
+		}
+	}
+
+	for _, candidate := range streams {
+		if candidate.RepairOf != nil || candidate.Rtx != nil || candidate.FlexFec != nil {
+			continue
+		}
+		var best *RtpStream
+		bestMatches := 0
+		for _, primary := range streams {
+			if primary == candidate || primary.RepairOf != nil || primary.Rtx != nil {
+				continue
+			}
+			matches, total := rtxMatches(candidate, primary)
+			if matches > bestMatches && float64(matches) >= RTX_ASSOCIATION_RATIO*float64(total) {
+				best = primary
+				bestMatches = matches
+			}
+		}
+		if best != nil {
+			log.Sdebug("rtx, 0x%08X retransmits 0x%08X", candidate.Ssrc, best.Ssrc)
+			best.Rtx = candidate
+			candidate.RepairOf = best
+		}
+	}
+}
+
+// flexFecMatches tells whether most packets of a candidate FlexFEC stream protect the primary stream
+// alone, under another payload type, with an SN base within its sequence numbers
+func flexFecMatches(fec *RtpStream, primary *RtpStream) bool {
+	if fec.PayloadType == primary.PayloadType {
+		return false
+	}
+	matches := 0
+	for _, p := range fec.RtpPackets {
+		if p.CC != 1 || p.Csrc[0] != primary.Ssrc || len(p.Payload) < 10 {
+			continue
+		}
+		if primary.inRange(binary.BigEndian.Uint16(p.Payload[8:])) {
+			matches++
+		}
+	}
+	return 2*matches > len(fec.RtpPackets)
+}
+
+// rtxMatches counts packets of a candidate RTX stream carrying an original sequence number
+// of the primary stream, with the same timestamp when the original was received
+func rtxMatches(rtx *RtpStream, primary *RtpStream) (matches int, total int) {
+	if rtx.PayloadType == primary.PayloadType ||
+		rtx.SrcIP != primary.SrcIP || rtx.SrcPort != primary.SrcPort ||
+		rtx.DstIP != primary.DstIP || rtx.DstPort != primary.DstPort {
+		return 0, 0
+	}
+	received := primary.packetsBySeq()
+	for _, p := range rtx.RtpPackets {
+		// padding only packets are bandwidth probes
+		if len(p.Payload) < 2 {
+			continue
+		}
+		total++
+		osn := binary.BigEndian.Uint16(p.Payload)
+		if !primary.inRange(osn) {
+			continue
+		}
+		if original, ok := received[osn]; ok && original.Timestamp != p.Timestamp {
+			continue
+		}
+		matches++
+	}
+	return matches, total
+}
+
+func (s *RtpStream) packetsBySeq() map[uint16]*RtpPacket {
+	packets := make(map[uint16]*RtpPacket)
+	for _, p := range s.RtpPackets {
+		packets[p.SequenceNumber] = p
+	}
+	return packets
+}
+
+// inRange compares plainly, AddPacket does not follow sequence number wraps
+func (s *RtpStream) inRange(seq uint16) bool {
+	return seq >= s.FirstSeq && seq <= s.CurSeq
+}
+
+// Repair returns a copy of the stream with recovered packets merged in and ULPFEC packets left out.
+// ULPFEC packets are told apart by payload type, negative when not used, also as primary RED block.
+// RTX packets are restored under the original payload type their own maps to, skipped when not mapped
+func (s *RtpStream) Repair(redPayloadType int, ulpfecPayloadType int, rtxPayloadTypes map[int]int) (*RtpStream, RepairReport) {
+	var report RepairReport
+
+	packets := s.RtpPackets
+	if s.Rtx != nil {
+		packets = append(append([]*RtpPacket{}, packets...), s.restoreRtx(rtxPayloadTypes, &report)...)
+	}
+
+	received := make(map[uint16]*RtpPacket)
+	var fecs []fecPacket
+	// ULPFEC packets take sequence numbers of this stream, FlexFEC ones do not
+	ulpfecs := 0
+	for _, p := range packets {
+		data, ok := ulpfecPayload(p, redPayloadType, ulpfecPayloadType)
+		if !ok {
+			received[p.SequenceNumber] = p
+			continue
+		}
+		report.FecPackets++
+		ulpfecs++
+		fec, err := parseUlpfec(p.ReceivedAt, data)
+		if err != nil {
+			log.Sdebug("%s, seq:%d", err, p.SequenceNumber)
+			continue
+		}
+		fecs = append(fecs, fec)
+	}
+	if s.FlexFec != nil {
+		for _, p := range s.FlexFec.RtpPackets {
+			report.FecPackets++
+			fec, err := parseFlexFec(p)
+			if err != nil {
+				log.Sdebug("%s, seq:%d", err, p.SequenceNumber)
+				continue
+			}
+			fecs = append(fecs, fec)
+		}
+	}
+
+	// a recovered packet may leave another FEC packet with a single one missing
+	for progress := true; progress; {
+		progress = false
+		remaining := fecs[:0]
+		for _, fec := range fecs {
+			var missing []uint16
+			for _, v := range fec.protected {
+				if _, ok := received[v]; !ok {
+					missing = append(missing, v)
+				}
+			}
+			if len(missing) > 1 {
+				remaining = append(remaining, fec)
+				continue
+			}
+			if len(missing) == 0 {
+				continue
+			}
+			recovered, err := s.recoverFec(fec, missing[0], received, redPayloadType)
+			if err != nil {
+				log.Sdebug("%s, seq:%d", err, missing[0])
+				continue
+			}
+			log.Sdebug("fec, seq:%d recovered", missing[0])
+			received[missing[0]] = recovered
+			report.RecoveredFec++
+			progress = true
+		}
+		fecs = remaining
+	}
+	report.UnrecoverableFec = len(fecs)
+
+	repaired := *s
+	repaired.RtpPackets = make([]*RtpPacket, 0, len(received))
+	for _, v := range received {
+		repaired.RtpPackets = append(repaired.RtpPackets, v)
+	}
+	// packets recovered ahead of the first one received sort before it, streams do not wrap
+	sort.Slice(repaired.RtpPackets, func(i, j int) bool {
+		return repaired.RtpPackets[i].SequenceNumber < repaired.RtpPackets[j].SequenceNumber
+	})
+	repaired.LostPackets = 0
+	if present := uint(len(received) + ulpfecs); s.TotalExpectedPackets > present {
+		repaired.LostPackets = s.TotalExpectedPackets - present
+	}
+	return &repaired, report
+}
+
+// RtxPayloadTypes infers the original payload type (apt) of each RTX payload type from
+// retransmissions of packets that were received too, those never seen so are left out
+func (s *RtpStream) RtxPayloadTypes() map[int]int {
+	received := s.packetsBySeq()
+	counts := make(map[int]map[int]int)
+	for _, p := range s.Rtx.RtpPackets {
+		if len(p.Payload) < 2 {
+			continue
+		}
+		original, ok := received[binary.BigEndian.Uint16(p.Payload)]
+		if !ok || original.Timestamp != p.Timestamp {
+			continue
+		}
+		if counts[p.PayloadType] == nil {
+			counts[p.PayloadType] = make(map[int]int)
+		}
+		counts[p.PayloadType][original.PayloadType]++
+	}
+
+	apt := make(map[int]int)
+	for rtx, originals := range counts {
+		best := 0
+		for payloadType, count := range originals {
+			if count > best {
+				apt[rtx] = payloadType
+				best = count
+			}
+		}
+	}
+	return apt
+}
+
+// restoreRtx rebuilds the original packets of retransmissions of packets not received
+func (s *RtpStream) restoreRtx(rtxPayloadTypes map[int]int, report *RepairReport) (restored []*RtpPacket) {
+	received := s.packetsBySeq()
+	for _, p := range s.Rtx.RtpPackets {
+		if len(p.Payload) < 2 {
+			continue
+		}
+		osn := binary.BigEndian.Uint16(p.Payload)
+		if _, ok := received[osn]; ok {
+			report.Retransmitted++
+			continue
+		}
+		if !s.inRange(osn) {
+			continue
+		}
+		apt, ok := rtxPayloadTypes[p.PayloadType]
+		if !ok {
+			log.Sdebug("rtx, seq:%d, payload type %d not mapped", osn, p.PayloadType)
+			continue
+		}
+
+		padding := 0
+		if p.Padding {
+			padding = int(p.Data[len(p.Data)-1])
+		}
+		header := len(p.Data) - len(p.Payload) - padding
+		data := append(append([]byte{}, p.Data[:header]...), p.Payload[2:]...)
+		data[0] &^= 0x20
+		data[1] = data[1]&0x80 | byte(apt)
+		binary.BigEndian.PutUint16(data[2:], osn)
+		binary.BigEndian.PutUint32(data[8:], s.Ssrc)
+
+		original, err := decodeRtpPacket(p.ReceivedAt, data)
+		if err != nil {
+			log.Sdebug("rtx, seq:%d, %s", osn, err)
+			continue
+		}
+		log.Sdebug("rtx, seq:%d recovered", osn)
+		received[osn] = original
+		restored = append(restored, original)
+		report.RecoveredRtx++
+	}
+	return restored
+}
+
+// fecPacket holds the recovery fields common to ULPFEC and FlexFEC
+// [P][X][CC(4)], [M][PT(7)], length recovery, TS recovery and the XOR of the protected payloads
+type fecPacket struct {
+	receivedAt time.Time
+	bits0      byte
+	bits1      byte
+	length     uint16
+	timestamp  uint32
+	payload    []byte
+	protected  []uint16
+}
+
+// ulpfecPayload returns the FEC header and payload when the packet is ULPFEC, plain or the primary RED block
+func ulpfecPayload(p *RtpPacket, redPayloadType int, ulpfecPayloadType int) ([]byte, bool) {
+	if ulpfecPayloadType < 0 {
+		return nil, false
+	}
+	if p.PayloadType == ulpfecPayloadType {
+		return p.Payload, true
+	}
+	if p.PayloadType == redPayloadType {
+		blocks, err := ParseRed(p.Payload)
+		if err == nil && blocks[len(blocks)-1].PayloadType == ulpfecPayloadType {
+			return blocks[len(blocks)-1].Payload, true
+		}
+	}
+	return nil, false
+}
+
+// parseUlpfec reads the FEC header and the level 0 header, higher levels are not used
+// FEC header := [E][L][P][X][CC(4)][M][PT(7)][SN base(16)][TS recovery(32)][length recovery(16)]
+// level header := [protection length(16)][mask(16)], 48 bit mask when L
+func parseUlpfec(receivedAt time.Time, data []byte) (fec fecPacket, err error) {
+	if len(data) < 14 {
+		return fec, errors.New("ulpfec, payload too short for header")
+	}
+	maskSize := 2
+	if data[0]&0x40 == 0x40 {
+		maskSize = 6
+	}
+	offset := 12 + maskSize
+	if len(data) < offset {
+		return fec, errors.New("ulpfec, payload too short for level header")
+	}
+
+	fec.receivedAt = receivedAt
+	fec.bits0 = data[0] & 0x3F
+	fec.bits1 = data[1]
+	fec.timestamp = binary.BigEndian.Uint32(data[4:])
+	fec.length = binary.BigEndian.Uint16(data[8:])
+	base := binary.BigEndian.Uint16(data[2:])
+	for i, v := range data[12:offset] {
+		for bit := 0; bit < 8; bit++ {
+			if v&(0x80>>uint(bit)) != 0 {
+				fec.protected = append(fec.protected, base+uint16(8*i+bit))
+			}
+		}
+	}
+
+	size := int(binary.BigEndian.Uint16(data[10:]))
+	if offset+size > len(data) {
+		size = len(data) - offset
+	}
+	fec.payload = data[offset : offset+size]
+	return fec, nil
+}
+
+// parseFlexFec reads a FlexFEC header protecting a single SSRC, the one in CSRC
+// header := [R][F][P][X][CC(4)][M][PT(7)][length recovery(16)][TS recovery(32)][SN base(16)]
+// F unset, [K][mask(15)], [K][mask(31)] and mask(64) until K is set
+// F set, [L(8)][D(8)], L consecutive packets when D <= 1, otherwise D packets L apart
+func parseFlexFec(p *RtpPacket) (fec fecPacket, err error) {
+	data := p.Payload
+	if len(data) < 12 {
+		return fec, errors.New("flexfec, payload too short for header")
+	}
+	if data[0]&0x80 == 0x80 {
+		return fec, errors.New("flexfec, retransmission not supported")
+	}
+	if p.CC != 1 {
+		return fec, errors.New("flexfec, only a single protected stream supported")
+	}
+
+	fec.receivedAt = p.ReceivedAt
+	fec.bits0 = data[0] & 0x3F
+	fec.bits1 = data[1]
+	fec.length = binary.BigEndian.Uint16(data[2:])
+	fec.timestamp = binary.BigEndian.Uint32(data[4:])
+	base := binary.BigEndian.Uint16(data[8:])
+
+	offset := 10
+	if data[0]&0x40 == 0x40 {
+		columns, rows := int(data[10]), int(data[11])
+		// D of 0 or 1 is row FEC, RFC 8627 section 4.2.2.1
+		if rows <= 1 {
+			for i := 0; i < columns; i++ {
+				fec.protected = append(fec.protected, base+uint16(i))
+			}
+		} else {
+			for i := 0; i < rows; i++ {
+				fec.protected = append(fec.protected, base+uint16(i*columns))
+			}
+		}
+		offset += 2
+	} else {
+		index := 0
+		for _, bits := range []int{15, 31, 64} {
+			size := (bits + 1) / 8
+			if len(data) < offset+size {
+				return fec, errors.New("flexfec, payload too short for mask")
+			}
+			var mask uint64
+			for _, v := range data[offset : offset+size] {
+				mask = mask<<8 | uint64(v)
+			}
+			offset += size
+			for bit := bits - 1; bit >= 0; bit-- {
+				if mask&(1<<uint(bit)) != 0 {
+					fec.protected = append(fec.protected, base+uint16(index))
+				}
+				index++
+			}
+			// K set in the first bit ends the mask, the last part has none
+			if bits == 64 || mask&(1<<uint(bits)) != 0 {
+				break
+			}
+		}
+	}
+	fec.payload = data[offset:]
+	return fec, nil
+}
+
+// recoverFec XORs the protected packets received into the FEC recovery fields to rebuild the missing one
+func (s *RtpStream) recoverFec(fec fecPacket, seq uint16, received map[uint16]*RtpPacket, redPayloadType int) (*RtpPacket, error) {
+	bits0, bits1, length, timestamp := fec.bits0, fec.bits1, fec.length, fec.timestamp
+	payload := append([]byte{}, fec.payload...)
+	for _, v := range fec.protected {
+		if v == seq {
+			continue
+		}
+		data := protectedData(received[v], redPayloadType)
+		bits0 ^= data[0] & 0x3F
+		bits1 ^= data[1]
+		timestamp ^= binary.BigEndian.Uint32(data[4:])
+		length ^= uint16(len(data) - 12)
+		for i := 0; i < len(payload) && 12+i < len(data); i++ {
+			payload[i] ^= data[12+i]
+		}
+	}
+	if int(length) > len(payload) {
+		return nil, errors.New("fec, protection shorter than the missing packet")
+	}
+
+	data := make([]byte, 12+int(length))
+	data[0] = 0x80 | bits0
+	data[1] = bits1
+	binary.BigEndian.PutUint16(data[2:], seq)
+	binary.BigEndian.PutUint32(data[4:], timestamp)
+	binary.BigEndian.PutUint32(data[8:], s.Ssrc)
+	copy(data[12:], payload)
+	return decodeRtpPacket(fec.receivedAt, data)
+}
+
+// protectedData returns the packet as FEC protected it, media packets sent in RED are
+// protected before being wrapped, under the payload type of their primary block
+func protectedData(p *RtpPacket, redPayloadType int) []byte {
+	if p.PayloadType != redPayloadType {
+		return p.Data
+	}
+	blocks, err := ParseRed(p.Payload)
+	if err != nil {
+		return p.Data
+	}
+	primary := blocks[len(blocks)-1]
+	padding := 0
+	if p.Padding {
+		padding = int(p.Data[len(p.Data)-1])
+	}
+	header := len(p.Data) - len(p.Payload) - padding
+	data := append(append([]byte{}, p.Data[:header]...), primary.Payload...)
+	data[0] &^= 0x20
+	data[1] = data[1]&0x80 | byte(primary.PayloadType)
+	return data
+}
+
+func decodeRtpPacket(receivedAt time.Time, data []byte) (*RtpPacket, error) {
+	packet := gopacket.NewPacket(data, RtpLayerType, gopacket.Default)
+	rtp, _ := packet.Layer(RtpLayerType).(*RtpLayer)
+	if rtp == nil {
+		return nil, errors.New("Not able to decode RTP layer")
+	}
+	rtp.ReceivedAt = receivedAt
+	return rtp.RtpPacket(), nil
+}
@@ -0,0 +1,234 @@
+package rtp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+const testSsrc = 0x11223344
+
+func testRtpPacket(t *testing.T, seq uint16, timestamp uint32, payloadType int, marker bool, ssrc uint32, csrc []uint32, payload []byte) *RtpPacket {
+	data := make([]byte, 12+4*len(csrc))
+	data[0] = 0x80 | byte(len(csrc))
+	data[1] = byte(payloadType)
+	if marker {
+		data[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(data[2:], seq)
+	binary.BigEndian.PutUint32(data[4:], timestamp)
+	binary.BigEndian.PutUint32(data[8:], ssrc)
+	for i, v := range csrc {
+		binary.BigEndian.PutUint32(data[12+4*i:], v)
+	}
+	packet, err := decodeRtpPacket(time.Time{}, append(data, payload...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packet
+}
+
+func testStream(packets ...*RtpPacket) *RtpStream {
+	stream := &RtpStream{Ssrc: testSsrc, PayloadType: packets[0].PayloadType, FirstSeq: packets[0].SequenceNumber}
+	for _, p := range packets {
+		stream.CurSeq = p.SequenceNumber
+		stream.RtpPackets = append(stream.RtpPackets, p)
+	}
+	stream.TotalExpectedPackets = uint(stream.CurSeq-stream.FirstSeq) + 1
+	return stream
+}
+
+// testFecFields XORs the recovery fields and payloads of the protected packets
+func testFecFields(packets []*RtpPacket) (bits0 byte, bits1 byte, timestamp uint32, length uint16, payload []byte) {
+	for _, p := range packets {
+		bits0 ^= p.Data[0] & 0x3F
+		bits1 ^= p.Data[1]
+		timestamp ^= p.Timestamp
+		length ^= uint16(len(p.Data) - 12)
+		if len(p.Data)-12 > len(payload) {
+			payload = append(payload, make([]byte, len(p.Data)-12-len(payload))...)
+		}
+		for i, v := range p.Data[12:] {
+			payload[i] ^= v
+		}
+	}
+	return
+}
+
+// testUlpfec builds the FEC header and level 0 header protecting packets from base
+func testUlpfec(base uint16, protected []*RtpPacket) []byte {
+	bits0, bits1, timestamp, length, payload := testFecFields(protected)
+	data := make([]byte, 14)
+	data[0] = bits0
+	data[1] = bits1
+	binary.BigEndian.PutUint16(data[2:], base)
+	binary.BigEndian.PutUint32(data[4:], timestamp)
+	binary.BigEndian.PutUint16(data[8:], length)
+	binary.BigEndian.PutUint16(data[10:], uint16(len(payload)))
+	var mask uint16
+	for _, p := range protected {
+		mask |= 0x8000 >> (p.SequenceNumber - base)
+	}
+	binary.BigEndian.PutUint16(data[12:], mask)
+	return append(data, payload...)
+}
+
+func TestRepairUlpfec(t *testing.T) {
+	media := []*RtpPacket{
+		testRtpPacket(t, 10, 3000, 96, false, testSsrc, nil, []byte{0x01, 0x02, 0x03}),
+		testRtpPacket(t, 11, 3000, 96, true, testSsrc, nil, []byte{0x04, 0x05, 0x06, 0x07, 0x08}),
+		testRtpPacket(t, 12, 6000, 96, false, testSsrc, nil, []byte{0x09}),
+	}
+	fec := testRtpPacket(t, 13, 6000, 127, false, testSsrc, nil, testUlpfec(10, media))
+
+	for lost := range media {
+		var received []*RtpPacket
+		for i, p := range media {
+			if i != lost {
+				received = append(received, p)
+			}
+		}
+		stream := testStream(append(received, fec)...)
+		repaired, report := stream.Repair(-1, 127, nil)
+
+		if report.RecoveredFec != 1 || report.FecPackets != 1 {
+			t.Errorf("lost %d: report %+v", lost, report)
+			continue
+		}
+		if len(repaired.RtpPackets) != len(media) {
+			t.Errorf("lost %d: got %d packets, expected %d", lost, len(repaired.RtpPackets), len(media))
+			continue
+		}
+		got, expected := repaired.RtpPackets[lost], media[lost]
+		if got.SequenceNumber != expected.SequenceNumber || got.Timestamp != expected.Timestamp ||
+			got.Marker != expected.Marker || got.PayloadType != expected.PayloadType ||
+			!bytes.Equal(got.Payload, expected.Payload) {
+			t.Errorf("lost %d: got %v % X, expected %v % X", lost, got, got.Payload, expected, expected.Payload)
+		}
+		if repaired.LostPackets != 0 {
+			t.Errorf("lost %d: %d packets still lost", lost, repaired.LostPackets)
+		}
+	}
+}
+
+func TestRepairUlpfecMoreThanOneMissing(t *testing.T) {
+	media := []*RtpPacket{
+		testRtpPacket(t, 10, 3000, 96, false, testSsrc, nil, []byte{0x01}),
+		testRtpPacket(t, 11, 3000, 96, false, testSsrc, nil, []byte{0x02}),
+		testRtpPacket(t, 12, 3000, 96, false, testSsrc, nil, []byte{0x03}),
+	}
+	fec := testRtpPacket(t, 13, 3000, 127, false, testSsrc, nil, testUlpfec(10, media))
+	stream := testStream(media[0], fec)
+
+	repaired, report := stream.Repair(-1, 127, nil)
+	if report.RecoveredFec != 0 || report.UnrecoverableFec != 1 {
+		t.Errorf("report %+v", report)
+	}
+	if repaired.LostPackets != 2 {
+		t.Errorf("got %d lost packets, expected 2", repaired.LostPackets)
+	}
+}
+
+func TestParseFlexFec(t *testing.T) {
+	header := func(f bool, base uint16, protection ...byte) []byte {
+		data := make([]byte, 10)
+		if f {
+			data[0] = 0x40
+		}
+		binary.BigEndian.PutUint16(data[8:], base)
+		return append(data, protection...)
+	}
+
+	tests := []struct {
+		name      string
+		data      []byte
+		protected []uint16
+	}{
+		{"15 bit mask", header(false, 100, 0x80|0x40, 0x01), []uint16{100, 114}},
+		{"31 bit mask", header(false, 100, 0x00, 0x01, 0x80, 0x00, 0x00, 0x01), []uint16{114, 145}},
+		{"64 bit mask", header(false, 100, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01), []uint16{146, 209}},
+		{"row, D 0", header(true, 100, 3, 0), []uint16{100, 101, 102}},
+		{"row, D 1", header(true, 100, 3, 1), []uint16{100, 101, 102}},
+		{"column", header(true, 100, 4, 3), []uint16{100, 104, 108}},
+	}
+
+	for _, test := range tests {
+		packet := testRtpPacket(t, 1, 0, 110, false, 0x55667788, []uint32{testSsrc}, append(test.data, 0xAA))
+		fec, err := parseFlexFec(packet)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if len(fec.protected) != len(test.protected) {
+			t.Errorf("%s: got %v, expected %v", test.name, fec.protected, test.protected)
+			continue
+		}
+		for i, v := range test.protected {
+			if fec.protected[i] != v {
+				t.Errorf("%s: got %v, expected %v", test.name, fec.protected, test.protected)
+				break
+			}
+		}
+		if !bytes.Equal(fec.payload, []byte{0xAA}) {
+			t.Errorf("%s: got payload % X", test.name, fec.payload)
+		}
+	}
+}
+
+func TestRepairRtx(t *testing.T) {
+	primary := testStream(
+		testRtpPacket(t, 10, 3000, 96, false, testSsrc, nil, []byte{0x01}),
+		testRtpPacket(t, 11, 3000, 100, false, testSsrc, nil, []byte{0x02}),
+		testRtpPacket(t, 14, 6000, 96, false, testSsrc, nil, []byte{0x05}),
+	)
+	// RTX payload types 97 and 101 retransmit 96 and 100, RFC 4588 apt
+	primary.Rtx = testStream(
+		testRtpPacket(t, 500, 3000, 97, false, 0x99, nil, []byte{0x00, 10, 0x01}),
+		testRtpPacket(t, 501, 3000, 101, false, 0x99, nil, []byte{0x00, 11, 0x02}),
+		testRtpPacket(t, 502, 6000, 97, true, 0x99, nil, []byte{0x00, 12, 0x03}),
+		testRtpPacket(t, 503, 6000, 101, false, 0x99, nil, []byte{0x00, 13, 0x04}),
+	)
+
+	apt := primary.RtxPayloadTypes()
+	if apt[97] != 96 || apt[101] != 100 {
+		t.Fatalf("got apt %v", apt)
+	}
+
+	repaired, report := primary.Repair(-1, -1, apt)
+	if report.RecoveredRtx != 2 || report.Retransmitted != 2 {
+		t.Errorf("report %+v", report)
+	}
+	expected := []struct {
+		seq         uint16
+		payloadType int
+		marker      bool
+		payload     byte
+	}{{10, 96, false, 0x01}, {11, 100, false, 0x02}, {12, 96, true, 0x03}, {13, 100, false, 0x04}, {14, 96, false, 0x05}}
+	if len(repaired.RtpPackets) != len(expected) {
+		t.Fatalf("got %d packets, expected %d", len(repaired.RtpPackets), len(expected))
+	}
+	for i, v := range expected {
+		p := repaired.RtpPackets[i]
+		if p.SequenceNumber != v.seq || p.PayloadType != v.payloadType || p.Marker != v.marker ||
+			p.Ssrc != testSsrc || !bytes.Equal(p.Payload, []byte{v.payload}) {
+			t.Errorf("packet %d: got seq:%d pt:%d marker:%t ssrc:%08X % X", i,
+				p.SequenceNumber, p.PayloadType, p.Marker, p.Ssrc, p.Payload)
+		}
+	}
+}
+
+func TestInRangeBeyondHalfSequenceSpace(t *testing.T) {
+	stream := &RtpStream{FirstSeq: 100, CurSeq: 100 + 40000}
+	for _, v := range []uint16{100, 30000, 40000, 100 + 40000} {
+		if !stream.inRange(v) {
+			t.Errorf("%d not in range", v)
+		}
+	}
+	for _, v := range []uint16{99, 100 + 40001} {
+		if stream.inRange(v) {
+			t.Errorf("%d in range", v)
+		}
+	}
+}
@@ -33,3 +33,55 @@ func (r RtpPacket) String() string {
 		r.Timestamp,
 	)
 }
+
+// GetExtensionElement returns the RFC 8285 header extension element with
+// the given id. Both one-byte and two-byte header forms are supported.
+func (r RtpPacket) GetExtensionElement(id int) ([]byte, bool) {
+	if !r.Extension || id <= 0 {
+		return nil, false
+	}
+
+	oneByte := r.ExtensionHeaderId == 0xBEDE
+	twoByte := r.ExtensionHeaderId&0xFFF0 == 0x1000
+	if !oneByte && !twoByte {
+		return nil, false
+	}
+
+	data := r.ExtensionHeader
+	for i := 0; i < len(data); {
+		var elementId, length int
+		if oneByte {
+			elementId = int(data[i] >> 4)
+			if elementId == 0 {
+				// padding
+				i++
+				continue
+			}
+			if elementId == 15 {
+				break
+			}
+			length = int(data[i]&0x0F) + 1
+			i++
+		} else {
+			elementId = int(data[i])
+			if elementId == 0 {
+				// padding
+				i++
+				continue
+			}
+			if i+1 >= len(data) {
+				break
+			}
+			length = int(data[i+1])
+			i += 2
+		}
+		if i+length > len(data) {
+			break
+		}
+		if elementId == id {
+			return data[i : i+length], true
+		}
+		i += length
+	}
+	return nil, false
+}
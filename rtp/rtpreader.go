@@ -70,6 +70,7 @@ func (r *RtpReader) GetStreams() []*RtpStream {
 			r.decodePacket(receivedAt, packet)
 		}
 	}
+	AssociateRepairStreams(r.rtpStreamsSorted)
 	return r.rtpStreamsSorted
 }
 
@@ -28,10 +28,23 @@ type RtpStream struct {
     MeanBandwidth float32
 
     RtpPackets []*RtpPacket
+
+    // Repair - RTX and FlexFEC streams associated by the reader
+    Rtx *RtpStream
+    FlexFec *RtpStream
+    RepairOf *RtpStream
+    // listing the stream as CSRC without looking like FlexFEC, used once confirmed
+    FlexFecCandidate *RtpStream
 }
 
 func (r RtpStream) String() string {
-  return fmt.Sprintf("%s - %s   0x%08X   %3d   %5d   %s:%d -> %s:%d",
+  repair := ""
+  if r.RepairOf != nil && r.RepairOf.Rtx != nil && r.RepairOf.Rtx.Ssrc == r.Ssrc {
+    repair = fmt.Sprintf("   rtx of 0x%08X", r.RepairOf.Ssrc)
+  } else if r.RepairOf != nil {
+    repair = fmt.Sprintf("   flexfec of 0x%08X", r.RepairOf.Ssrc)
+  }
+  return fmt.Sprintf("%s - %s   0x%08X   %3d   %5d   %s:%d -> %s:%d%s",
     util.TimeToStr(r.StartTime),
     util.TimeToStr(r.EndTime),
     r.Ssrc,
@@ -41,6 +54,7 @@ func (r RtpStream) String() string {
     r.SrcPort,
     r.DstIP,
     r.DstPort,
+    repair,
   )
 }
 